@@ -0,0 +1,272 @@
+/*
+	Optional challenge-response authentication using pre-shared keys. It
+	runs right after a connection is made, before any other frames:
+
+		server -> client  challenge: 32 random bytes
+		client -> server  response:  key ID + HMAC-SHA256(key, challenge)
+		server -> client  result:    accepted or rejected
+
+	The key itself never crosses the wire, and since every challenge is
+	fresh a recorded response is useless for a later connection. The server
+	looks the key up by its ID and, once the MAC checks out, maps the key ID
+	to an identity that handlers can read from their context.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	authChallenge uint8 = iota + 1
+	authResponse
+	authAccepted
+	authRejected
+)
+
+const authNonceSize = 32
+
+// maxAuthFrameSize comfortably fits the largest auth frame: a 255-byte key ID
+// and a MAC, or a rejection reason. The peer hasn't proven anything yet when
+// these are read, so it doesn't get to make us buffer a full-size frame.
+const maxAuthFrameSize = 1 << 10
+
+// DefaultAuthTimeout is how long RPCServer gives a peer to authenticate.
+const DefaultAuthTimeout = 10 * time.Second
+
+var ErrAuthFailed = errors.New("authentication failed")
+
+// AuthFrame carries one step of the exchange. Data is the challenge, the MAC
+// or the rejection reason depending on Kind; KeyID is only set on responses.
+type AuthFrame struct {
+	Kind  uint8
+	KeyID string
+	Data  []byte
+}
+
+func (m AuthFrame) Bytes() []byte { return m.Data }
+
+func (m AuthFrame) String() string { return fmt.Sprintf("auth kind %d key %q", m.Kind, m.KeyID) }
+
+func (m AuthFrame) WriteTo(w io.Writer) (int64, error) {
+	if len(m.KeyID) > 0xff {
+		return 0, errors.New("auth: key ID too long")
+	}
+
+	// kind + key ID length + key ID + data
+	body := make([]byte, 0, 2+len(m.KeyID)+len(m.Data))
+	body = append(body, m.Kind, uint8(len(m.KeyID)))
+	body = append(body, m.KeyID...)
+	body = append(body, m.Data...)
+
+	return writeFrame(w, AuthType, body)
+}
+
+func (m *AuthFrame) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	if err != nil {
+		return n, err
+	}
+
+	if len(body) < 2 || len(body) < 2+int(body[1]) {
+		return n, fmt.Errorf("%w: malformed frame", ErrAuthFailed)
+	}
+
+	m.Kind = body[0]
+	m.KeyID = string(body[2 : 2+int(body[1])])
+	m.Data = body[2+int(body[1]):]
+
+	return n, nil
+}
+
+// KeyStore looks up pre-shared keys by ID.
+type KeyStore interface {
+	Key(id string) ([]byte, bool)
+}
+
+// StaticKeys is a fixed KeyStore.
+type StaticKeys map[string][]byte
+
+func (k StaticKeys) Key(id string) ([]byte, bool) {
+	key, ok := k[id]
+	return key, ok
+}
+
+// Authenticator runs the server side of the exchange.
+type Authenticator struct {
+	Keys KeyStore
+
+	// Identify maps an authenticated key ID to the identity handlers see.
+	// Returning an error rejects the peer even though its key was valid,
+	// e.g. for a revoked key. If nil, the identity is the key ID.
+	Identify func(keyID string) (string, error)
+}
+
+// Authenticate challenges the peer and returns its identity. The caller is
+// expected to have set a deadline on the connection so a silent peer can't
+// hold it up forever, as RPCServer does with AuthTimeout. On failure the
+// peer is told it was rejected, but not why, so it can't probe for valid key
+// IDs. Frames that aren't auth frames, or are bigger than any auth frame
+// could be, are rejected unread.
+func (a *Authenticator) Authenticate(rw io.ReadWriter) (string, error) {
+	nonce := make([]byte, authNonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = (&AuthFrame{Kind: authChallenge, Data: nonce}).WriteTo(rw)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := readAuthFrame(rw, authResponse)
+	if err != nil {
+		return "", err
+	}
+
+	identity, err := a.verify(nonce, resp)
+	if err != nil {
+		_, _ = (&AuthFrame{Kind: authRejected, Data: []byte(ErrAuthFailed.Error())}).WriteTo(rw)
+		return "", err
+	}
+
+	_, err = (&AuthFrame{Kind: authAccepted}).WriteTo(rw)
+	if err != nil {
+		return "", err
+	}
+
+	return identity, nil
+}
+
+func (a *Authenticator) verify(nonce []byte, resp *AuthFrame) (string, error) {
+	key, ok := a.Keys.Key(resp.KeyID)
+	if !ok {
+		return "", fmt.Errorf("%w: unknown key ID %q", ErrAuthFailed, resp.KeyID)
+	}
+
+	if !hmac.Equal(resp.Data, authMAC(key, nonce, resp.KeyID)) {
+		return "", fmt.Errorf("%w: bad MAC for key ID %q", ErrAuthFailed, resp.KeyID)
+	}
+
+	if a.Identify == nil {
+		return resp.KeyID, nil
+	}
+
+	identity, err := a.Identify(resp.KeyID)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+
+	return identity, nil
+}
+
+// SendCredentials runs the client side of the exchange, proving that we hold
+// the key for keyID.
+func SendCredentials(rw io.ReadWriter, keyID string, key []byte) error {
+	challenge, err := readAuthFrame(rw, authChallenge)
+	if err != nil {
+		return err
+	}
+
+	if len(challenge.Data) != authNonceSize {
+		return fmt.Errorf("%w: challenge is %d bytes", ErrAuthFailed, len(challenge.Data))
+	}
+
+	_, err = (&AuthFrame{
+		Kind:  authResponse,
+		KeyID: keyID,
+		Data:  authMAC(key, challenge.Data, keyID),
+	}).WriteTo(rw)
+	if err != nil {
+		return err
+	}
+
+	result, err := nextAuthFrame(rw)
+	if err != nil {
+		return err
+	}
+
+	if result.Kind != authAccepted {
+		return fmt.Errorf("%w: rejected by server", ErrAuthFailed)
+	}
+
+	return nil
+}
+
+// authMAC binds the MAC to the key ID as well as the challenge, so a response
+// can't be replayed under a different key ID.
+func authMAC(key, nonce []byte, keyID string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("tlv-auth-v1"))
+	mac.Write(nonce)
+	mac.Write([]byte(keyID))
+
+	return mac.Sum(nil)
+}
+
+// readAuthFrame reads the next frame, which has to be an auth frame of the
+// given kind.
+func readAuthFrame(r io.Reader, kind uint8) (*AuthFrame, error) {
+	f, err := nextAuthFrame(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Kind != kind {
+		return nil, fmt.Errorf("%w: unexpected %v", ErrAuthFailed, f)
+	}
+
+	return f, nil
+}
+
+// nextAuthFrame reads the next frame, which has to be an auth frame of no
+// more than maxAuthFrameSize bytes.
+func nextAuthFrame(r io.Reader) (*AuthFrame, error) {
+	var header [5]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing but auth frames is decoded, so the peer can't have us inflate
+	// a compressed frame or the like before it's authenticated.
+	if header[0] != AuthType {
+		return nil, fmt.Errorf("%w: unexpected frame type %d", ErrAuthFailed, header[0])
+	}
+
+	if size := binary.BigEndian.Uint32(header[1:]); size > maxAuthFrameSize {
+		return nil, fmt.Errorf("%w: %d byte frame", ErrAuthFailed, size)
+	}
+
+	f := new(AuthFrame)
+
+	_, err = f.ReadFrom(io.MultiReader(bytes.NewReader(header[1:]), r))
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying an authenticated identity.
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity the peer authenticated as, if any.
+func IdentityFromContext(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(identityKey{}).(string)
+	return identity, ok
+}
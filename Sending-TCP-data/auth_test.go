@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAuthenticatedRPC(t *testing.T) {
+	keys := StaticKeys{
+		"ci":      []byte("Clear is better than clever."),
+		"revoked": []byte("Don't panic."),
+	}
+
+	server := NewRPCServer()
+	server.Authenticator = &Authenticator{
+		Keys: keys,
+		Identify: func(keyID string) (string, error) {
+			if keyID == "revoked" {
+				return "", errors.New("key revoked")
+			}
+
+			return keyID + "-bot", nil
+		},
+	}
+	server.Handle("whoami", func(ctx context.Context, _ Payload) (Payload, error) {
+		identity, _ := IdentityFromContext(ctx)
+		s := String(identity)
+
+		return &s, nil
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go func() { _ = server.Serve(listener) }()
+
+	for _, c := range []struct {
+		keyID string
+		key   []byte
+		ok    bool
+	}{
+		{"ci", keys["ci"], true},
+		{"ci", []byte("wrong key"), false},
+		{"unknown", keys["ci"], false},
+		{"revoked", keys["revoked"], false},
+	} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = SendCredentials(conn, c.keyID, c.key)
+		if !c.ok {
+			if !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("%s: expected ErrAuthFailed; actual: %v", c.keyID, err)
+			}
+
+			_ = conn.Close()
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %v", c.keyID, err)
+		}
+
+		client := NewRPCClient(conn)
+
+		reply, err := client.Call(context.Background(), "whoami", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reply.String() != "ci-bot" {
+			t.Errorf("expected identity %q; actual %q", "ci-bot", reply)
+		}
+
+		_ = client.Close()
+	}
+}
+
+func TestAuthUnauthenticatedRequest(t *testing.T) {
+	zeros := Binary(make([]byte, 1<<20))
+
+	for _, p := range []Payload{
+		&Request{ID: 1, Method: "whoami"},
+		// well under the auth frame limit, but inflates to a megabyte
+		&Compressed{Payload: &zeros},
+	} {
+		client, server := net.Pipe()
+
+		a := &Authenticator{Keys: StaticKeys{}}
+		errs := make(chan error)
+		go func() {
+			_, err := a.Authenticate(server)
+			errs <- err
+		}()
+
+		// skip the challenge and go straight to something else; the
+		// server stops reading once it sees the type, so don't wait on
+		// the write
+		_, _ = decode(client)
+		go func(p Payload) { _, _ = p.WriteTo(client) }(p)
+
+		if err := <-errs; !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%T: expected ErrAuthFailed; actual: %v", p, err)
+		}
+
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
+
+func TestAuthSilentPeer(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	server := NewRPCServer()
+	server.Authenticator = &Authenticator{Keys: StaticKeys{}}
+	server.AuthTimeout = 100 * time.Millisecond
+
+	errs := make(chan error)
+	go func() { errs <- server.ServeConn(context.Background(), conn) }()
+
+	// Read the challenge, then never answer it.
+	_, err := decode(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("expected os.ErrDeadlineExceeded; actual: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server kept waiting on a silent peer")
+	}
+}
+
+func TestAuthOversizedFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	a := &Authenticator{Keys: StaticKeys{}}
+	errs := make(chan error)
+	go func() {
+		_, err := a.Authenticate(server)
+		errs <- err
+	}()
+
+	_, _ = decode(client)
+
+	// Only the header is sent: the body would never be read anyway.
+	_, _ = client.Write([]byte{AuthType, 0x00, 0xa0, 0x00, 0x00})
+
+	if err := <-errs; !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("expected ErrAuthFailed; actual: %v", err)
+	}
+}
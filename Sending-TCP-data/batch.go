@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBatchThreshold is how many buffered bytes trigger a flush
+	// without waiting for the delay.
+	DefaultBatchThreshold = 64 << 10
+
+	// Bodies at least this big are handed to writev as they are rather than
+	// copied into the batch.
+	batchCopyLimit = 4 << 10
+)
+
+var ErrBatchWriterClosed = errors.New("batch writer closed")
+
+// BatchWriter coalesces frames and sends them with a single vectored write
+// (writev on TCP and Unix conns), instead of the three small writes each
+// Payload.WriteTo makes. Frame headers and small bodies are copied into one
+// contiguous buffer; large Binary bodies are referenced in place, so they
+// must not be modified until the batch has been flushed.
+//
+// Buffered frames go out when Flush is called, when Threshold bytes have
+// piled up or, much like Nagle's algorithm, once Delay has passed since the
+// first frame of the batch. A write error from a background flush is
+// returned by the next call to Write or Flush. BatchWriter is safe for
+// concurrent use.
+type BatchWriter struct {
+	// Threshold is the batch size in bytes that triggers an immediate flush.
+	Threshold int
+
+	// Delay is how long a frame may wait for company. If zero, frames are
+	// only sent by Flush or when Threshold is reached.
+	Delay time.Duration
+
+	mu       sync.Mutex
+	w        io.Writer
+	arena    []byte
+	bufs     net.Buffers
+	tail     int // start of the last arena chunk in bufs, -1 if there isn't one
+	size     int
+	timer    *time.Timer
+	timerGen uint64 // bumped for every timer, so a stale one can tell
+	err      error
+	closed   bool
+}
+
+func NewBatchWriter(w io.Writer, delay time.Duration) *BatchWriter {
+	return &BatchWriter{
+		Threshold: DefaultBatchThreshold,
+		Delay:     delay,
+		w:         w,
+		tail:      -1,
+	}
+}
+
+// Write adds p to the current batch.
+func (b *BatchWriter) Write(p Payload) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrBatchWriterClosed
+	}
+
+	if b.err != nil {
+		return b.err
+	}
+
+	err := b.add(p)
+	if err != nil {
+		return err
+	}
+
+	if b.size >= b.Threshold {
+		return b.flush()
+	}
+
+	if b.Delay > 0 && b.timer == nil {
+		b.startTimer()
+	}
+
+	return nil
+}
+
+// startTimer arms the timer that flushes the current batch after Delay.
+func (b *BatchWriter) startTimer() {
+	b.timerGen++
+	gen := b.timerGen
+	b.timer = time.AfterFunc(b.Delay, func() { b.autoFlush(gen) })
+}
+
+// Flush sends everything buffered so far.
+func (b *BatchWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+
+	return b.flush()
+}
+
+// Close flushes the remaining frames. It doesn't close the underlying writer.
+func (b *BatchWriter) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+
+	b.closed = true
+
+	if b.err != nil {
+		return b.err
+	}
+
+	return b.flush()
+}
+
+// autoFlush flushes the batch the timer of generation gen was started for.
+// A timer that fires while a Flush holds the lock can't be stopped any more;
+// by the time it gets the lock its batch is gone and b.timer may belong to a
+// newer one, which it must leave alone.
+func (b *BatchWriter) autoFlush(gen uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.timer == nil || gen != b.timerGen {
+		return
+	}
+
+	b.timer = nil
+
+	if b.err == nil {
+		_ = b.flush()
+	}
+}
+
+func (b *BatchWriter) add(p Payload) error {
+	ptr, ok := p.(*Binary)
+
+	// Anything that isn't a Binary is encoded by its own WriteTo, straight
+	// into the arena.
+	if !ok {
+		_, err := p.WriteTo(batchArena{b})
+		return err
+	}
+
+	body := *ptr
+	if uint64(len(body)) > uint64(MaxPayloadSize) {
+		return ErrMaxPayloadSize
+	}
+
+	var header [5]byte
+	header[0] = BinaryType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
+	b.copy(header[:])
+
+	if len(body) < batchCopyLimit {
+		b.copy(body)
+		return nil
+	}
+
+	b.bufs = append(b.bufs, body)
+	b.tail = -1
+	b.size += len(body)
+
+	return nil
+}
+
+// copy appends p to the arena, extending the last buffer when it's the
+// arena chunk just before p so that consecutive small frames end up in a
+// single iovec.
+func (b *BatchWriter) copy(p []byte) {
+	start := len(b.arena)
+	b.arena = append(b.arena, p...)
+	b.size += len(p)
+
+	// Growing the arena moves it, but the new array holds a copy of the whole
+	// last chunk, so re-slicing it is enough. Earlier chunks keep pointing at
+	// the old array, which is still intact.
+	if b.tail >= 0 {
+		b.bufs[len(b.bufs)-1] = b.arena[b.tail:]
+		return
+	}
+
+	b.tail = start
+	b.bufs = append(b.bufs, b.arena[start:])
+}
+
+func (b *BatchWriter) flush() error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	if b.size == 0 {
+		return nil
+	}
+
+	// WriteTo consumes the slice it's called on, so work on a copy of the
+	// header to keep b.bufs' backing array for the next batch.
+	bufs := b.bufs
+	_, err := bufs.WriteTo(b.w)
+
+	for i := range b.bufs {
+		b.bufs[i] = nil // don't pin large bodies until the next flush
+	}
+
+	b.bufs = b.bufs[:0]
+	b.arena = b.arena[:0]
+	b.tail = -1
+	b.size = 0
+
+	if err != nil {
+		b.err = err
+	}
+
+	return err
+}
+
+// batchArena lets a Payload's WriteTo encode itself into the arena.
+type batchArena struct{ b *BatchWriter }
+
+func (a batchArena) Write(p []byte) (int, error) {
+	a.b.copy(p)
+	return len(p), nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingWriter records every Write call it gets.
+type countingWriter struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.writes++
+
+	return w.buf.Write(p)
+}
+
+func (w *countingWriter) stats() (writes, n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.writes, w.buf.Len()
+}
+
+func TestBatchWriter(t *testing.T) {
+	w := new(countingWriter)
+	bw := NewBatchWriter(w, 0)
+
+	large := Binary(bytes.Repeat([]byte{'x'}, batchCopyLimit))
+	payloads := []Payload{
+		binaryPayload("Clear is better than clever."),
+		stringPayload("Errors are values."),
+		&large,
+		binaryPayload("Don't panic."),
+		&Record{{ID: 1, Value: stringPayload("gopher")}},
+	}
+
+	for _, p := range payloads {
+		err := bw.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if writes, _ := w.stats(); writes != 0 {
+		t.Fatalf("expected nothing written before Flush; actual: %d writes", writes)
+	}
+
+	err := bw.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The small frames either side of the large body are coalesced, so the
+	// batch is three buffers: frames before it plus its header, the body
+	// itself, and the frames after it.
+	if writes, _ := w.stats(); writes != 3 {
+		t.Errorf("expected 3 writes; actual: %d", writes)
+	}
+
+	for i, expected := range payloads {
+		actual, err := decode(&w.buf)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+
+		if !bytes.Equal(actual.Bytes(), expected.Bytes()) {
+			t.Errorf("frame %d: expected %q; actual: %q", i, expected, actual)
+		}
+	}
+}
+
+func TestBatchWriterThreshold(t *testing.T) {
+	w := new(countingWriter)
+	bw := NewBatchWriter(w, 0)
+	bw.Threshold = 100
+
+	p := Binary(bytes.Repeat([]byte{'x'}, 40))
+
+	for i := 0; i < 2; i++ {
+		err := bw.Write(&p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if writes, _ := w.stats(); writes != 0 {
+		t.Fatalf("expected nothing written below the threshold; actual: %d writes", writes)
+	}
+
+	err := bw.Write(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if writes, n := w.stats(); writes != 1 || n != 3*(5+40) {
+		t.Errorf("expected 1 write of %d bytes; actual: %d writes of %d bytes", 3*(5+40), writes, n)
+	}
+}
+
+func TestBatchWriterDelay(t *testing.T) {
+	w := new(countingWriter)
+	bw := NewBatchWriter(w, 50*time.Millisecond)
+
+	start := time.Now()
+
+	for i := 0; i < 10; i++ {
+		err := bw.Write(stringPayload("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for {
+		writes, n := w.stats()
+		if writes > 0 {
+			if writes != 1 || n != 10*(5+4) {
+				t.Errorf("expected one write of all frames; actual: %d writes of %d bytes", writes, n)
+			}
+
+			break
+		}
+
+		if time.Since(start) > time.Second {
+			t.Fatal("batch wasn't flushed after the delay")
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected flush after 50ms; actual: %s", elapsed)
+	}
+}
+
+func TestBatchWriterStaleTimer(t *testing.T) {
+	w := new(countingWriter)
+	bw := NewBatchWriter(w, 10*time.Millisecond)
+
+	err := bw.Write(stringPayload("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the lock as a Flush would while the timer fires, so it's left
+	// waiting for the lock. The Flush sends the batch and a Write starts the
+	// next one, with a timer that shouldn't go off for a long time.
+	bw.mu.Lock()
+	time.Sleep(50 * time.Millisecond)
+
+	err = bw.flush()
+	if err != nil {
+		bw.mu.Unlock()
+		t.Fatal(err)
+	}
+
+	err = bw.add(stringPayload("pong"))
+	if err != nil {
+		bw.mu.Unlock()
+		t.Fatal(err)
+	}
+
+	bw.Delay = time.Hour
+	bw.startTimer()
+	next := bw.timer
+	bw.mu.Unlock()
+
+	// Give the stale timer the lock.
+	time.Sleep(50 * time.Millisecond)
+
+	if writes, n := w.stats(); writes != 1 || n != 5+4 {
+		t.Errorf("expected only the first batch to be sent; actual: %d writes of %d bytes", writes, n)
+	}
+
+	bw.mu.Lock()
+	current := bw.timer
+	bw.mu.Unlock()
+
+	if current != next {
+		t.Error("the stale timer dropped the new batch's timer")
+	}
+
+	err = bw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, io.ErrClosedPipe }
+
+func TestBatchWriterStickyError(t *testing.T) {
+	bw := NewBatchWriter(failingWriter{}, 0)
+
+	err := bw.Write(stringPayload("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bw.Flush()
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("expected io.ErrClosedPipe; actual: %v", err)
+	}
+
+	err = bw.Write(stringPayload("ping"))
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected io.ErrClosedPipe from later writes; actual: %v", err)
+	}
+
+	_ = bw.Close()
+
+	err = NewBatchWriter(io.Discard, 0).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// benchmarkConn returns the client end of a loopback TCP connection whose
+// server end discards everything it reads.
+func benchmarkConn(b *testing.B) net.Conn {
+	b.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		_, _ = io.Copy(io.Discard, conn)
+		_ = conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Cleanup(func() {
+		_ = conn.Close()
+		<-done
+		_ = listener.Close()
+	})
+
+	return conn
+}
+
+// Each benchmark sends 64-byte frames over loopback TCP, one frame per
+// iteration.
+
+func BenchmarkPayloadWriteTo(b *testing.B) {
+	conn := benchmarkConn(b)
+	p := Binary(bytes.Repeat([]byte{'x'}, 64))
+
+	b.SetBytes(5 + 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := p.WriteTo(conn)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBatchWriter(b *testing.B) {
+	conn := benchmarkConn(b)
+	p := Binary(bytes.Repeat([]byte{'x'}, 64))
+	bw := NewBatchWriter(conn, time.Millisecond)
+
+	b.SetBytes(5 + 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := bw.Write(&p)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	err := bw.Flush()
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkBatchWriterLargeFrames(b *testing.B) {
+	conn := benchmarkConn(b)
+	p := Binary(bytes.Repeat([]byte{'x'}, 16<<10))
+	bw := NewBatchWriter(conn, time.Millisecond)
+
+	b.SetBytes(5 + 16<<10)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := bw.Write(&p)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	err := bw.Flush()
+	if err != nil {
+		b.Fatal(err)
+	}
+}
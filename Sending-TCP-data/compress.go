@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// CompressionThreshold is the default size, in bytes, a payload has to reach
+// before Compressed deflates it. Smaller payloads rarely shrink enough to be
+// worth the CPU time, so they're written as plain frames.
+const CompressionThreshold = 1 << 10 // 1KB
+
+var ErrInvalidCompressed = errors.New("invalid compressed payload")
+
+// Compressed wraps a Payload and DEFLATE-compresses it on the wire. The frame
+// body is the 1-byte type of the wrapped payload followed by the compressed
+// bytes. decode unwraps compressed frames transparently, so the receiver gets
+// back the original *Binary or *String.
+type Compressed struct {
+	Payload
+
+	// Threshold is the minimum payload size that gets compressed. Zero means
+	// CompressionThreshold.
+	Threshold int
+}
+
+func (c Compressed) WriteTo(w io.Writer) (n int64, err error) {
+	typ, err := payloadType(c.Payload)
+	if err != nil {
+		return 0, err
+	}
+
+	threshold := c.Threshold
+	if threshold <= 0 {
+		threshold = CompressionThreshold
+	}
+
+	data := c.Payload.Bytes()
+	if len(data) < threshold {
+		return c.Payload.WriteTo(w)
+	}
+
+	// The receiver rejects anything that inflates beyond MaxPayloadSize, so
+	// there's no point sending it.
+	if uint64(len(data)) > uint64(MaxPayloadSize) {
+		return 0, ErrMaxPayloadSize
+	}
+
+	body := new(bytes.Buffer)
+	body.WriteByte(typ)
+
+	fw, err := flate.NewWriter(body, flate.DefaultCompression)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = fw.Write(data)
+	if err != nil {
+		return 0, err
+	}
+
+	err = fw.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	err = binary.Write(w, binary.BigEndian, CompressedType)
+	if err != nil {
+		return 0, err
+	}
+
+	n = 1
+
+	err = binary.Write(w, binary.BigEndian, uint32(body.Len()))
+	if err != nil {
+		return n, err
+	}
+
+	n += 4
+
+	o, err := w.Write(body.Bytes())
+
+	return n + int64(o), err
+}
+
+func (c *Compressed) ReadFrom(r io.Reader) (int64, error) {
+	var n int64 = 1
+
+	var size uint32
+	err := binary.Read(r, binary.BigEndian, &size)
+	if err != nil {
+		return n, err
+	}
+
+	n += 4
+
+	if size > MaxPayloadSize {
+		return n, ErrMaxPayloadSize
+	}
+
+	if size < 1 {
+		return n, ErrInvalidCompressed
+	}
+
+	body := make([]byte, size)
+	o, err := io.ReadFull(r, body)
+	n += int64(o)
+	if err != nil {
+		return n, err
+	}
+
+	_, err = c.parse(body, int64(MaxPayloadSize))
+
+	return n, err
+}
+
+// parse decodes body, the body of a Compressed frame, inflating at most limit
+// bytes. It returns the number of bytes inflated, so callers decoding several
+// compressed frames can share one limit between them.
+func (c *Compressed) parse(body []byte, limit int64) (int64, error) {
+	if len(body) < 1 {
+		return 0, ErrInvalidCompressed
+	}
+
+	// WriteTo only ever compresses a Binary or a String. Anything else is
+	// refused: a frame that holds frames of its own, like a Request, could
+	// carry another compressed frame and get around the size check below.
+	var payload Payload
+
+	switch body[0] {
+	case BinaryType:
+		payload = new(Binary)
+	case StingType:
+		payload = new(String)
+	default:
+		return 0, ErrInvalidCompressed
+	}
+
+	// A few kilobytes of deflated zeros can expand to gigabytes, so the limit
+	// has to be enforced on the inflated size and not just the frame size.
+	// Reading one byte past the limit tells us it was exceeded without ever
+	// holding more than that in memory.
+	fr := flate.NewReader(bytes.NewReader(body[1:]))
+	defer fr.Close()
+
+	data, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil {
+		return 0, ErrInvalidCompressed
+	}
+
+	if int64(len(data)) > limit {
+		return 0, ErrMaxPayloadSize
+	}
+
+	if len(data) == 0 {
+		return 0, ErrInvalidCompressed
+	}
+
+	// Hand the inflated bytes to the payload's own ReadFrom, prefixed with
+	// the 4-byte size it expects.
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+
+	_, err = payload.ReadFrom(io.MultiReader(bytes.NewReader(header), bytes.NewReader(data)))
+	if err != nil {
+		return 0, err
+	}
+
+	c.Payload = payload
+
+	return int64(len(data)), nil
+}
+
+// payloadType returns the type field used on the wire for p.
+func payloadType(p Payload) (uint8, error) {
+	switch p.(type) {
+	case *Binary:
+		return BinaryType, nil
+	case *String:
+		return StingType, nil
+	default:
+		return 0, errors.New("unsupported payload type")
+	}
+}
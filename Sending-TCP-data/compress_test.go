@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompressedPayload(t *testing.T) {
+	large := String(strings.Repeat(`{"level":"info","msg":"Errors are values."}`, 100))
+	small := Binary("Don't panic.")
+
+	buf := new(bytes.Buffer)
+
+	for _, p := range []Payload{&Compressed{Payload: &large}, &Compressed{Payload: &small}} {
+		_, err := p.WriteTo(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if buf.Bytes()[0] != CompressedType {
+		t.Fatalf("expected large payload to be compressed; type: %d", buf.Bytes()[0])
+	}
+
+	// large payload frame + uncompressed small payload frame
+	if limit := len(large) / 2; buf.Len() > limit {
+		t.Errorf("expected at most %d bytes on the wire; actual: %d", limit, buf.Len())
+	}
+
+	for _, expected := range []Payload{&large, &small} {
+		actual, err := decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("value mismatch: %v != %v", expected, actual)
+		}
+	}
+}
+
+func TestCompressedMaxPayloadSize(t *testing.T) {
+	// MaxPayloadSize+1 zero bytes deflate down to a few kilobytes, well
+	// under the frame size limit.
+	body := new(bytes.Buffer)
+	body.WriteByte(BinaryType)
+
+	fw, err := flate.NewWriter(body, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fw.Write(make([]byte, MaxPayloadSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(CompressedType)
+
+	err = binary.Write(buf, binary.BigEndian, uint32(body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = body.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = decode(buf)
+	if err != ErrMaxPayloadSize {
+		t.Fatalf("expected ErrMaxPayloadSize; actual: %v", err)
+	}
+}
+
+func TestCompressedInnerTypes(t *testing.T) {
+	// A compressed Request whose body is compressed in turn.
+	inner := new(bytes.Buffer)
+	_, err := (&Request{ID: 1, Method: "put", Body: &Compressed{
+		Payload:   binaryPayload("Clear is better than clever."),
+		Threshold: 1,
+	}}).WriteTo(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typ := range []uint8{RequestType, CompressedType, RecordType} {
+		body := new(bytes.Buffer)
+		body.WriteByte(typ)
+
+		fw, err := flate.NewWriter(body, flate.DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _ = fw.Write(inner.Bytes()[1:])
+		_ = fw.Close()
+
+		buf := new(bytes.Buffer)
+		buf.WriteByte(CompressedType)
+		_ = binary.Write(buf, binary.BigEndian, uint32(body.Len()))
+		_, _ = body.WriteTo(buf)
+
+		_, err = decode(buf)
+		if err != ErrInvalidCompressed {
+			t.Errorf("type %d: expected ErrInvalidCompressed; actual: %v", typ, err)
+		}
+	}
+}
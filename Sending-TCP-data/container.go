@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxContainerDepth is how deeply Records and Lists may be nested in one
+// frame. Decoding recurses once per level, so without a limit a frame of
+// nothing but nested headers could exhaust the stack.
+const MaxContainerDepth = 32
+
+var ErrInvalidContainer = errors.New("invalid container")
+
+// Field is a single member of a Record.
+type Field struct {
+	ID    uint16
+	Value Payload
+}
+
+// Record is a container of numbered fields. Each field is encoded as its
+// 2-byte ID followed by the field's own frame, so a Record can hold any
+// payload, including other Records.
+type Record []Field
+
+func (m Record) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	_ = m.writeBody(buf)
+
+	return buf.Bytes()
+}
+
+func (m Record) String() string { return fmt.Sprintf("record(%d fields)", len(m)) }
+
+func (m Record) WriteTo(w io.Writer) (int64, error) {
+	buf := new(bytes.Buffer)
+
+	err := m.writeBody(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	return writeFrame(w, RecordType, buf.Bytes())
+}
+
+func (m Record) writeBody(buf *bytes.Buffer) error {
+	for _, f := range m {
+		_ = binary.Write(buf, binary.BigEndian, f.ID)
+
+		_, err := f.Value.WriteTo(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Record) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	if err != nil {
+		return n, err
+	}
+
+	budget := int64(MaxPayloadSize)
+
+	return n, m.parse(body, 1, &budget)
+}
+
+// parse decodes the fields in body, a Record nested depth levels deep. Its
+// compressed members may inflate to no more than *budget bytes between them.
+func (m *Record) parse(body []byte, depth int, budget *int64) error {
+	*m = (*m)[:0]
+
+	for len(body) > 0 {
+		if len(body) < 2 {
+			return ErrInvalidContainer
+		}
+
+		id := binary.BigEndian.Uint16(body)
+
+		p, rest, err := decodeMember(body[2:], depth, budget)
+		if err != nil {
+			return err
+		}
+
+		*m = append(*m, Field{ID: id, Value: p})
+		body = rest
+	}
+
+	return nil
+}
+
+// Field returns the value of the field with the given ID.
+func (m Record) Field(id uint16) (Payload, bool) {
+	for _, f := range m {
+		if f.ID == id {
+			return f.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// List is a container of payloads, encoded back to back.
+type List []Payload
+
+func (m List) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	_ = m.writeBody(buf)
+
+	return buf.Bytes()
+}
+
+func (m List) String() string { return fmt.Sprintf("list(%d items)", len(m)) }
+
+func (m List) WriteTo(w io.Writer) (int64, error) {
+	buf := new(bytes.Buffer)
+
+	err := m.writeBody(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	return writeFrame(w, ListType, buf.Bytes())
+}
+
+func (m List) writeBody(buf *bytes.Buffer) error {
+	for _, p := range m {
+		_, err := p.WriteTo(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *List) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	if err != nil {
+		return n, err
+	}
+
+	budget := int64(MaxPayloadSize)
+
+	return n, m.parse(body, 1, &budget)
+}
+
+// parse decodes the items in body, a List nested depth levels deep. Its
+// compressed members may inflate to no more than *budget bytes between them.
+func (m *List) parse(body []byte, depth int, budget *int64) error {
+	*m = (*m)[:0]
+
+	for len(body) > 0 {
+		p, rest, err := decodeMember(body, depth, budget)
+		if err != nil {
+			return err
+		}
+
+		*m = append(*m, p)
+		body = rest
+	}
+
+	return nil
+}
+
+// Unknown holds a frame whose type this build doesn't know about. Containers
+// keep such members as Unknown instead of failing, so a peer running a newer
+// version can add types without breaking older readers. It's written back
+// out unchanged.
+type Unknown struct {
+	Type uint8
+	Data []byte
+}
+
+func (m Unknown) Bytes() []byte { return m.Data }
+
+func (m Unknown) String() string {
+	return fmt.Sprintf("unknown type %d (%d bytes)", m.Type, len(m.Data))
+}
+
+func (m Unknown) WriteTo(w io.Writer) (int64, error) { return writeFrame(w, m.Type, m.Data) }
+
+func (m *Unknown) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	m.Data = body
+
+	return n, err
+}
+
+// decodeMember decodes the frame at the start of body, a member of a
+// container nested depth levels deep, and returns what follows it. Nested
+// containers are parsed from sub-slices of body rather than copies of it, so
+// decoding a frame takes memory in proportion to its size however deeply
+// it's nested. Unlike decode, frames of an unknown type are returned as
+// *Unknown.
+//
+// Compressed members are inflated out of *budget, which is shared by every
+// member of the top-level frame. Each one could otherwise inflate to
+// MaxPayloadSize, and a frame holding thousands of them would expand to
+// thousands of times that.
+func decodeMember(body []byte, depth int, budget *int64) (Payload, []byte, error) {
+	if len(body) < 5 {
+		return nil, nil, ErrInvalidContainer
+	}
+
+	typ := body[0]
+
+	size := binary.BigEndian.Uint32(body[1:5])
+	if uint64(size) > uint64(len(body)-5) {
+		return nil, nil, ErrInvalidContainer
+	}
+
+	frame, rest := body[:5+size], body[5+size:]
+
+	switch typ {
+	case RecordType, ListType, RequestType, ResponseType:
+		// Requests and responses hold a frame of their own, so they count
+		// towards the depth like containers do.
+		if depth >= MaxContainerDepth {
+			return nil, nil, fmt.Errorf("%w: nested more than %d deep", ErrInvalidContainer, MaxContainerDepth)
+		}
+	case CompressedType:
+		// Containers are never compressed by WriteTo. A compressed one
+		// would start counting its depth afresh, and inflate every level
+		// into memory at once, so it's refused.
+		if size > 0 && (frame[5] == RecordType || frame[5] == ListType) {
+			return nil, nil, ErrInvalidContainer
+		}
+	}
+
+	var (
+		p   Payload
+		err error
+	)
+
+	switch typ {
+	case RecordType:
+		rec := new(Record)
+		p, err = rec, rec.parse(frame[5:], depth+1, budget)
+	case ListType:
+		l := new(List)
+		p, err = l, l.parse(frame[5:], depth+1, budget)
+	case RequestType:
+		req := new(Request)
+		p, err = req, req.parse(frame[5:], depth+1, budget)
+	case ResponseType:
+		resp := new(Response)
+		p, err = resp, resp.parse(frame[5:], depth+1, budget)
+	case CompressedType:
+		c := new(Compressed)
+
+		var inflated int64
+
+		inflated, err = c.parse(frame[5:], *budget)
+		*budget -= inflated
+		p = c.Payload
+	default:
+		p, err = newPayload(typ)
+		if err != nil {
+			return &Unknown{Type: typ, Data: frame[5:]}, rest, nil
+		}
+
+		// ReadFrom expects the type to have been consumed already.
+		_, err = p.ReadFrom(bytes.NewReader(frame[1:]))
+	}
+
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrInvalidContainer
+		}
+
+		return nil, nil, err
+	}
+
+	return p, rest, nil
+}
@@ -0,0 +1,125 @@
+/*
+	Datagram mode lets the TLV frames travel over UDP and unixgram sockets.
+	A datagram carries one or more whole frames back to back and nothing
+	else: a frame is never split across datagrams, and a datagram with a
+	truncated frame or trailing bytes is rejected outright rather than
+	partially decoded.
+
+	Datagrams are kept within an MTU budget. A datagram bigger than the path
+	MTU gets fragmented by IP, and losing any one fragment loses the lot, so
+	oversized datagrams are refused when sending and when receiving.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// DefaultDatagramMTU fits a 1500-byte Ethernet MTU once the 20-byte IPv4 and
+// 8-byte UDP headers are taken off.
+const DefaultDatagramMTU = 1500 - 20 - 8
+
+var (
+	ErrDatagramTooLarge = errors.New("datagram exceeds MTU budget")
+	ErrInvalidDatagram  = errors.New("invalid datagram")
+)
+
+// EncodeDatagram packs payloads into a single datagram of at most mtu bytes.
+func EncodeDatagram(mtu int, payloads ...Payload) ([]byte, error) {
+	if len(payloads) == 0 {
+		return nil, fmt.Errorf("%w: no payloads", ErrInvalidDatagram)
+	}
+
+	buf := new(bytes.Buffer)
+
+	for _, p := range payloads {
+		_, err := p.WriteTo(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if buf.Len() > mtu {
+			return nil, fmt.Errorf("%w: more than %d bytes", ErrDatagramTooLarge, mtu)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeDatagram unpacks every frame in b. Each frame header is checked
+// against what's left of the datagram before the frame is decoded, and the
+// frame's decoder must consume its body exactly. Heartbeats are checked but
+// left out of the result.
+func DecodeDatagram(b []byte) ([]Payload, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidDatagram)
+	}
+
+	var payloads []Payload
+
+	for offset := 0; offset < len(b); {
+		if len(b)-offset < 5 {
+			return nil, fmt.Errorf("%w: %d trailing bytes at offset %d", ErrInvalidDatagram, len(b)-offset, offset)
+		}
+
+		size := binary.BigEndian.Uint32(b[offset+1:])
+		if uint64(size) > uint64(len(b)-offset-5) {
+			return nil, fmt.Errorf("%w: frame at offset %d claims %d bytes, only %d left",
+				ErrInvalidDatagram, offset, size, len(b)-offset-5)
+		}
+
+		end := offset + 5 + int(size)
+
+		p, err := ParseFrame(b[offset:end])
+		if err != nil {
+			return nil, fmt.Errorf("%w: frame at offset %d: %v", ErrInvalidDatagram, offset, err)
+		}
+
+		if !isHeartbeat(p) {
+			payloads = append(payloads, p)
+		}
+
+		offset = end
+	}
+
+	return payloads, nil
+}
+
+// WriteDatagramTo sends payloads to addr as a single datagram.
+func WriteDatagramTo(pc net.PacketConn, addr net.Addr, mtu int, payloads ...Payload) error {
+	b, err := EncodeDatagram(mtu, payloads...)
+	if err != nil {
+		return err
+	}
+
+	_, err = pc.WriteTo(b, addr)
+
+	return err
+}
+
+// ReadDatagramFrom reads one datagram and returns its payloads along with the
+// sender's address. Datagrams bigger than mtu are rejected; the address is
+// returned regardless, so the sender can be told or logged.
+func ReadDatagramFrom(pc net.PacketConn, mtu int) ([]Payload, net.Addr, error) {
+	// One spare byte tells an oversized datagram apart from one that's
+	// exactly mtu bytes; anything beyond the buffer is discarded by the
+	// kernel.
+	buf := make([]byte, mtu+1)
+
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		return nil, addr, err
+	}
+
+	if n > mtu {
+		return nil, addr, fmt.Errorf("%w: more than %d bytes", ErrDatagramTooLarge, mtu)
+	}
+
+	payloads, err := DecodeDatagram(buf[:n])
+
+	return payloads, addr, err
+}
@@ -0,0 +1,45 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDatagramUnixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datagram_unixgram")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if rErr := os.RemoveAll(dir); rErr != nil {
+			t.Error(rErr)
+		}
+	}()
+
+	server, err := net.ListenPacket("unixgram", filepath.Join(dir, "s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.Close() }()
+
+	client, err := net.ListenPacket("unixgram", filepath.Join(dir, "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	payloads := []Payload{
+		stringPayload("cpu=0.42"),
+		stringPayload("mem=0.17"),
+		binaryPayload("\x00\x01\x02"),
+	}
+
+	checkDatagramPayloads(t, payloads, exchangeDatagram(t, client, server, payloads...))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// exchangeDatagram sends payloads from client to server as one datagram and
+// returns what the server decoded.
+func exchangeDatagram(t *testing.T, client, server net.PacketConn, payloads ...Payload) []Payload {
+	t.Helper()
+
+	err := WriteDatagramTo(client, server.LocalAddr(), DefaultDatagramMTU, payloads...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	received, addr, err := ReadDatagramFrom(server, DefaultDatagramMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr.String() != client.LocalAddr().String() {
+		t.Errorf("expected datagram from %s; actual: %s", client.LocalAddr(), addr)
+	}
+
+	return received
+}
+
+func checkDatagramPayloads(t *testing.T, expected, actual []Payload) {
+	t.Helper()
+
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d payloads; actual: %d", len(expected), len(actual))
+	}
+
+	for i := range expected {
+		if !bytes.Equal(actual[i].Bytes(), expected[i].Bytes()) {
+			t.Errorf("payload %d: expected %q; actual: %q", i, expected[i], actual[i])
+		}
+	}
+}
+
+func TestDatagramUDP(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.Close() }()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	payloads := []Payload{
+		stringPayload("cpu=0.42"),
+		binaryPayload("\x00\x01\x02"),
+		&Record{{ID: 1, Value: stringPayload("host-1")}},
+	}
+
+	checkDatagramPayloads(t, payloads, exchangeDatagram(t, client, server, payloads...))
+}
+
+func TestDatagramTooLarge(t *testing.T) {
+	big := Binary(bytes.Repeat([]byte{'x'}, DefaultDatagramMTU))
+
+	_, err := EncodeDatagram(DefaultDatagramMTU, &big)
+	if !errors.Is(err, ErrDatagramTooLarge) {
+		t.Errorf("expected ErrDatagramTooLarge; actual: %v", err)
+	}
+
+	// Several frames that only overflow together are rejected too.
+	half := Binary(bytes.Repeat([]byte{'x'}, DefaultDatagramMTU/2))
+
+	_, err = EncodeDatagram(DefaultDatagramMTU, &half, &half)
+	if !errors.Is(err, ErrDatagramTooLarge) {
+		t.Errorf("expected ErrDatagramTooLarge; actual: %v", err)
+	}
+
+	// Datagrams that a peer sends over budget are refused on arrival.
+	server, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.Close() }()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	b, err := EncodeDatagram(2*DefaultDatagramMTU, &half, &half)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.WriteTo(b, server.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, _, err = ReadDatagramFrom(server, DefaultDatagramMTU)
+	if !errors.Is(err, ErrDatagramTooLarge) {
+		t.Errorf("expected ErrDatagramTooLarge; actual: %v", err)
+	}
+}
+
+func TestDecodeDatagramStrict(t *testing.T) {
+	valid, err := EncodeDatagram(DefaultDatagramMTU, stringPayload("cpu=0.42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, b := range map[string][]byte{
+		"empty":           {},
+		"trailing bytes":  append(append([]byte{}, valid...), 0xff, 0xff),
+		"truncated frame": valid[:len(valid)-1],
+		"oversized size":  {BinaryType, 0xff, 0xff, 0xff, 0xff},
+		"unknown type":    {0xfe, 0, 0, 0, 0},
+	} {
+		_, err := DecodeDatagram(b)
+		if !errors.Is(err, ErrInvalidDatagram) {
+			t.Errorf("%s: expected ErrInvalidDatagram; actual: %v", name, err)
+		}
+	}
+}
+
+func TestDecodeDatagramSkipsHeartbeats(t *testing.T) {
+	expected := []Payload{stringPayload("cpu=0.42"), binaryPayload("mem=0.17")}
+
+	b, err := EncodeDatagram(DefaultDatagramMTU,
+		&Ping{Seq: 1, Sent: time.Now()}, expected[0], &Pong{Seq: 1, Sent: time.Now()}, expected[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := DecodeDatagram(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkDatagramPayloads(t, expected, actual)
+}
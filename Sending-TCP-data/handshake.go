@@ -0,0 +1,257 @@
+/*
+	Before exchanging payloads, both peers send a Hello describing what they
+	speak: a range of protocol versions, the largest frame they'll accept,
+	optional features and the payload types they understand. Each side then
+	works out the same Agreement from the two hellos, i.e the highest common
+	version, the smaller frame size and the features and types both support.
+	Because the rules are symmetric there's no need for a third message to
+	confirm the result; if one side rejects the peer, so does the other.
+*/
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	ProtocolVersion    uint16 = 1 // the newest version this build speaks
+	MinProtocolVersion uint16 = 1 // the oldest version this build still speaks
+)
+
+// Feature is a bit set of optional protocol features.
+type Feature uint32
+
+const (
+	FeatureCompression Feature = 1 << iota // Compressed frames
+	_                                      // reserved: formerly per-frame checksums, never implemented
+	FeatureRPC                             // Request, Response and RPCError frames
+	FeatureMux                             // MuxFrame stream multiplexing
+)
+
+func (f Feature) Has(feature Feature) bool { return f&feature == feature }
+
+func (f Feature) String() string {
+	var names []string
+
+	for _, n := range []struct {
+		f    Feature
+		name string
+	}{
+		{FeatureCompression, "compression"},
+		{FeatureRPC, "rpc"},
+		{FeatureMux, "mux"},
+	} {
+		if f.Has(n.f) {
+			names = append(names, n.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, ",")
+}
+
+var ErrHandshake = errors.New("handshake failed")
+
+// HandshakeError explains why a peer was rejected.
+type HandshakeError struct {
+	Reason        string
+	Local, Remote Hello
+}
+
+func (e *HandshakeError) Error() string { return "handshake: " + e.Reason }
+
+func (e *HandshakeError) Is(target error) bool { return target == ErrHandshake }
+
+// Hello is the opening frame each peer sends.
+type Hello struct {
+	MinVersion   uint16
+	MaxVersion   uint16
+	MaxFrameSize uint32
+	Features     Feature
+	Types        []uint8 // payload types this peer can decode
+}
+
+// DefaultHello describes what this build supports.
+func DefaultHello() Hello {
+	return Hello{
+		MinVersion:   MinProtocolVersion,
+		MaxVersion:   ProtocolVersion,
+		MaxFrameSize: MaxPayloadSize,
+		Features:     FeatureCompression | FeatureRPC | FeatureMux,
+		Types: []uint8{BinaryType, StingType, CompressedType, RequestType, ResponseType,
+			ErrorType, MuxType, RecordType, ListType, ChunkType, TrailerType,
+			PingType, PongType},
+	}
+}
+
+func (m Hello) Bytes() []byte {
+	// min version + max version + max frame size + features + types
+	b := make([]byte, 12, 12+len(m.Types))
+	binary.BigEndian.PutUint16(b, m.MinVersion)
+	binary.BigEndian.PutUint16(b[2:], m.MaxVersion)
+	binary.BigEndian.PutUint32(b[4:], m.MaxFrameSize)
+	binary.BigEndian.PutUint32(b[8:], uint32(m.Features))
+
+	return append(b, m.Types...)
+}
+
+func (m Hello) String() string {
+	return fmt.Sprintf("v%d-%d max frame %d features %s types %v",
+		m.MinVersion, m.MaxVersion, m.MaxFrameSize, m.Features, m.Types)
+}
+
+func (m Hello) WriteTo(w io.Writer) (int64, error) { return writeFrame(w, HelloType, m.Bytes()) }
+
+func (m *Hello) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	if err != nil {
+		return n, err
+	}
+
+	if len(body) < 12 {
+		return n, &HandshakeError{Reason: "hello frame too short"}
+	}
+
+	m.MinVersion = binary.BigEndian.Uint16(body)
+	m.MaxVersion = binary.BigEndian.Uint16(body[2:])
+	m.MaxFrameSize = binary.BigEndian.Uint32(body[4:])
+	m.Features = Feature(binary.BigEndian.Uint32(body[8:]))
+	m.Types = body[12:]
+
+	return n, nil
+}
+
+// Agreement is the common ground two peers settled on. Nothing holds the
+// connection to it by itself: set MaxFrameSize on the Decoder reading from
+// the peer, and check Features and Supports before sending anything the peer
+// may not understand.
+type Agreement struct {
+	Version      uint16
+	MaxFrameSize uint32
+	Features     Feature
+	Types        []uint8
+	Remote       Hello
+}
+
+// Supports reports whether both peers can decode typ.
+func (a Agreement) Supports(typ uint8) bool {
+	for _, t := range a.Types {
+		if t == typ {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Handshake sends local to the peer, reads the peer's hello and negotiates.
+// The write happens in the background so two peers on an unbuffered
+// connection, like net.Pipe, don't block each other. If the peer's hello
+// can't be read and rw is an io.Closer, rw is closed and the write waited
+// for, so it doesn't outlive the call.
+func Handshake(rw io.ReadWriter, local Hello) (Agreement, error) {
+	written := make(chan error, 1)
+	go func() {
+		_, err := local.WriteTo(rw)
+		written <- err
+	}()
+
+	p, err := decode(rw)
+	if err != nil {
+		if c, ok := rw.(io.Closer); ok {
+			_ = c.Close()
+			<-written
+		}
+
+		return Agreement{}, fmt.Errorf("reading hello: %w", err)
+	}
+
+	if err := <-written; err != nil {
+		return Agreement{}, fmt.Errorf("sending hello: %w", err)
+	}
+
+	remote, ok := p.(*Hello)
+	if !ok {
+		return Agreement{}, &HandshakeError{
+			Reason: fmt.Sprintf("expected hello; peer sent %T", p),
+			Local:  local,
+		}
+	}
+
+	return Negotiate(local, *remote)
+}
+
+// Negotiate works out the Agreement between two hellos. Both are held to the
+// same rules, since the peer negotiates with the two the other way round and
+// has to come to the same conclusion.
+func Negotiate(local, remote Hello) (Agreement, error) {
+	reject := func(format string, a ...any) (Agreement, error) {
+		return Agreement{}, &HandshakeError{
+			Reason: fmt.Sprintf(format, a...),
+			Local:  local,
+			Remote: remote,
+		}
+	}
+
+	for _, h := range []struct {
+		who   string
+		hello Hello
+	}{{"we", local}, {"peer", remote}} {
+		if h.hello.MinVersion > h.hello.MaxVersion {
+			return reject("%s sent an empty version range %d-%d", h.who, h.hello.MinVersion, h.hello.MaxVersion)
+		}
+
+		if h.hello.MaxFrameSize == 0 {
+			return reject("%s advertised a maximum frame size of 0", h.who)
+		}
+	}
+
+	version := local.MaxVersion
+	if remote.MaxVersion < version {
+		version = remote.MaxVersion
+	}
+
+	if version < local.MinVersion || version < remote.MinVersion {
+		return reject("no common protocol version: we speak %d-%d, peer speaks %d-%d",
+			local.MinVersion, local.MaxVersion, remote.MinVersion, remote.MaxVersion)
+	}
+
+	maxFrame := local.MaxFrameSize
+	if remote.MaxFrameSize < maxFrame {
+		maxFrame = remote.MaxFrameSize
+	}
+
+	var types []uint8
+	for _, t := range local.Types {
+		for _, r := range remote.Types {
+			if t == r {
+				types = append(types, t)
+				break
+			}
+		}
+	}
+
+	a := Agreement{
+		Version:      version,
+		MaxFrameSize: maxFrame,
+		Features:     local.Features & remote.Features,
+		Types:        types,
+		Remote:       remote,
+	}
+
+	// Binary and String are the baseline every peer has to understand.
+	for _, t := range []uint8{BinaryType, StingType} {
+		if !a.Supports(t) {
+			return reject("peer doesn't support required payload type %d", t)
+		}
+	}
+
+	return a, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// an older peer: no mux, a smaller frame limit and one version behind
+	// what the other side prefers
+	local := DefaultHello()
+	local.MaxVersion = 2
+
+	remote := DefaultHello()
+	remote.MaxFrameSize = 1 << 20
+	remote.Features = FeatureCompression | FeatureRPC
+	remote.Types = []uint8{BinaryType, StingType, CompressedType, RequestType, ResponseType, ErrorType}
+
+	results := make(chan Agreement, 1)
+	go func() {
+		a, err := Handshake(server, remote)
+		if err != nil {
+			t.Error(err)
+		}
+		results <- a
+	}()
+
+	a, err := Handshake(client, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Version != 1 {
+		t.Errorf("expected version 1; actual: %d", a.Version)
+	}
+
+	if a.MaxFrameSize != 1<<20 {
+		t.Errorf("expected max frame size %d; actual: %d", 1<<20, a.MaxFrameSize)
+	}
+
+	if a.Features.Has(FeatureMux) || !a.Features.Has(FeatureCompression|FeatureRPC) {
+		t.Errorf("expected compression and rpc; actual: %s", a.Features)
+	}
+
+	if a.Supports(MuxType) {
+		t.Error("expected mux frames to be unsupported")
+	}
+
+	// both sides reach the same conclusion
+	b := <-results
+	a.Remote, b.Remote = Hello{}, Hello{}
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("peers disagree:\n%+v\n%+v", a, b)
+	}
+}
+
+func TestHandshakeIncompatible(t *testing.T) {
+	newer := DefaultHello()
+	newer.MinVersion, newer.MaxVersion = ProtocolVersion+1, ProtocolVersion+2
+
+	noStrings := DefaultHello()
+	noStrings.Types = []uint8{BinaryType}
+
+	for _, remote := range []Hello{newer, noStrings} {
+		_, err := Negotiate(DefaultHello(), remote)
+		if !errors.Is(err, ErrHandshake) {
+			t.Errorf("expected handshake error for %v; actual: %v", remote, err)
+			continue
+		}
+
+		t.Log(err)
+	}
+}
+
+func TestNegotiateInvalidHello(t *testing.T) {
+	emptyRange := DefaultHello()
+	emptyRange.MinVersion, emptyRange.MaxVersion = 2, 1
+
+	noFrames := DefaultHello()
+	noFrames.MaxFrameSize = 0
+
+	// Whichever side is at fault, both of them reject it.
+	for _, bad := range []Hello{emptyRange, noFrames} {
+		_, err := Negotiate(bad, DefaultHello())
+		if !errors.Is(err, ErrHandshake) {
+			t.Errorf("expected handshake error for local %v; actual: %v", bad, err)
+		}
+
+		_, err = Negotiate(DefaultHello(), bad)
+		if !errors.Is(err, ErrHandshake) {
+			t.Errorf("expected handshake error for remote %v; actual: %v", bad, err)
+		}
+	}
+}
+
+func TestHandshakeNotHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = decode(server)
+
+		s := String("Don't panic.")
+		_, _ = s.WriteTo(server)
+	}()
+
+	_, err := Handshake(client, DefaultHello())
+	if !errors.Is(err, ErrHandshake) {
+		t.Fatalf("expected handshake error; actual: %v", err)
+	}
+}
+
+func TestHandshakeReadFailure(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// The peer sends an oversized frame header and never reads our hello,
+	// which would leave the write blocked if the connection weren't closed.
+	go func() { _, _ = server.Write([]byte{BinaryType, 0xff, 0xff, 0xff, 0xff}) }()
+
+	_, err := Handshake(client, DefaultHello())
+	if err == nil {
+		t.Fatal("expected handshake to fail")
+	}
+
+	_, err = client.Write([]byte{0})
+	if err != io.ErrClosedPipe {
+		t.Errorf("expected the connection to be closed; actual: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	ch03 "practice/network_programming/TCP"
+)
+
+// Ping asks the peer to answer with a Pong carrying the same Seq and Sent.
+// Sent is the sender's own clock, so the round-trip time can be worked out
+// when the pong comes back without the two clocks having to agree.
+type Ping struct {
+	Seq  uint32
+	Sent time.Time
+}
+
+// Pong answers a Ping.
+type Pong Ping
+
+func (m Ping) Bytes() []byte { return heartbeatBody(m.Seq, m.Sent) }
+
+func (m Ping) String() string { return fmt.Sprintf("ping %d", m.Seq) }
+
+func (m Ping) WriteTo(w io.Writer) (int64, error) {
+	return writeFrame(w, PingType, m.Bytes())
+}
+
+func (m *Ping) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	if err != nil {
+		return n, err
+	}
+
+	m.Seq, m.Sent, err = parseHeartbeat(body)
+
+	return n, err
+}
+
+func (m Pong) Bytes() []byte { return heartbeatBody(m.Seq, m.Sent) }
+
+func (m Pong) String() string { return fmt.Sprintf("pong %d", m.Seq) }
+
+func (m Pong) WriteTo(w io.Writer) (int64, error) {
+	return writeFrame(w, PongType, m.Bytes())
+}
+
+func (m *Pong) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	if err != nil {
+		return n, err
+	}
+
+	m.Seq, m.Sent, err = parseHeartbeat(body)
+
+	return n, err
+}
+
+// isHeartbeat reports whether p is a Ping or Pong. Readers that have no way
+// to answer pings skip heartbeats so they stay invisible to their callers.
+func isHeartbeat(p Payload) bool {
+	switch p.(type) {
+	case *Ping, *Pong:
+		return true
+	default:
+		return false
+	}
+}
+
+// heartbeatBody encodes the sequence number followed by the send time in
+// nanoseconds since the Unix epoch.
+func heartbeatBody(seq uint32, sent time.Time) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b, seq)
+	binary.BigEndian.PutUint64(b[4:], uint64(sent.UnixNano()))
+
+	return b
+}
+
+func parseHeartbeat(body []byte) (uint32, time.Time, error) {
+	if len(body) != 12 {
+		return 0, time.Time{}, fmt.Errorf("heartbeat: body is %d bytes, expected 12", len(body))
+	}
+
+	return binary.BigEndian.Uint32(body), time.Unix(0, int64(binary.BigEndian.Uint64(body[4:]))), nil
+}
+
+// Decoder reads payloads like decode does, but deals with heartbeats itself:
+// pings are answered with pongs and pongs update the measured round-trip
+// time. Neither is ever returned to the caller.
+type Decoder struct {
+	// OnRTT, if set, is called with each round-trip time measured.
+	OnRTT func(rtt time.Duration)
+
+	// OnPong, if set, is called for each pong received, right after OnRTT.
+	OnPong func(Pong)
+
+	// MaxFrameSize, if set, rejects frames with a larger body than that with
+	// ErrMaxPayloadSize, e.g. the size agreed on in the handshake.
+	MaxFrameSize uint32
+
+	r    io.Reader
+	send func(Payload) error
+
+	mu  sync.Mutex
+	rtt time.Duration
+}
+
+// NewDecoder decodes payloads from r and answers pings using send, which has
+// to be safe to call while the application is sending too.
+func NewDecoder(r io.Reader, send func(Payload) error) *Decoder {
+	return &Decoder{r: r, send: send}
+}
+
+// Decode returns the next payload that isn't a heartbeat.
+func (d *Decoder) Decode() (Payload, error) {
+	for {
+		p, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch m := p.(type) {
+		case *Ping:
+			err = d.send(&Pong{Seq: m.Seq, Sent: m.Sent})
+			if err != nil {
+				return nil, err
+			}
+		case *Pong:
+			d.pong(*m)
+		default:
+			return p, nil
+		}
+	}
+}
+
+// next decodes the next frame, holding it to MaxFrameSize.
+func (d *Decoder) next() (Payload, error) {
+	if d.MaxFrameSize == 0 {
+		return decode(d.r)
+	}
+
+	header := make([]byte, 5)
+
+	_, err := io.ReadFull(d.r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(header[1:]) > d.MaxFrameSize {
+		return nil, ErrMaxPayloadSize
+	}
+
+	return decodeType(header[0], io.MultiReader(bytes.NewReader(header[1:]), d.r))
+}
+
+// RTT returns the most recently measured round-trip time, or zero if no pong
+// has been received yet.
+func (d *Decoder) RTT() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.rtt
+}
+
+func (d *Decoder) pong(m Pong) {
+	rtt := time.Since(m.Sent)
+	if rtt < 0 {
+		rtt = 0 // the wall clock was stepped back
+	}
+
+	d.mu.Lock()
+	d.rtt = rtt
+	d.mu.Unlock()
+
+	if d.OnRTT != nil {
+		d.OnRTT(rtt)
+	}
+
+	if d.OnPong != nil {
+		d.OnPong(m)
+	}
+}
+
+// FramedPinger is ch03.Pinger for connections carrying frames: it sends a
+// Ping frame on every tick instead of raw bytes, using send so pings don't
+// interleave with the application's own frames. The pongs are picked up by
+// a Decoder on the reading side, which reports the RTT.
+func FramedPinger(ctx context.Context, send func(Payload) error, reset <-chan time.Duration) {
+	ch03.PingerFunc(ctx, pingSender(send), reset)
+}
+
+// pingSender returns a function sending numbered Ping frames.
+func pingSender(send func(Payload) error) func() error {
+	var seq uint32
+
+	return func() error {
+		seq++
+		return send(&Ping{Seq: seq, Sent: time.Now()})
+	}
+}
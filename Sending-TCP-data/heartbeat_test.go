@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	ch03 "practice/network_programming/TCP"
+)
+
+// payloadConnPair returns both ends of a loopback TCP connection.
+func payloadConnPair(t *testing.T) (client, server *PayloadConn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sConn := <-accepted
+	if sConn == nil {
+		t.FailNow()
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = sConn.Close()
+	})
+
+	return NewPayloadConn(conn), NewPayloadConn(sConn)
+}
+
+func TestHeartbeatFrames(t *testing.T) {
+	client, server := payloadConnPair(t)
+
+	// The server echoes everything it receives; it never sees the pings.
+	go func() {
+		for {
+			p, err := server.Receive()
+			if err != nil {
+				return
+			}
+
+			if _, ok := p.(*Ping); ok {
+				t.Errorf("ping surfaced to the application")
+			}
+
+			err = server.Send(p)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reset := make(chan time.Duration, 1)
+	reset <- 10 * time.Millisecond
+
+	go client.Ping(ctx, reset)
+
+	var rtts int
+	client.dec.OnRTT = func(rtt time.Duration) { rtts++ }
+
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+
+		err := client.Send(stringPayload("Clear is better than clever."))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := client.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.String() != "Clear is better than clever." {
+			t.Fatalf("unexpected payload: %v", p)
+		}
+	}
+
+	if rtts == 0 {
+		t.Fatal("expected round-trip times to be measured")
+	}
+
+	if rtt := client.RTT(); rtt <= 0 || rtt > time.Second {
+		t.Errorf("unexpected RTT: %s", rtt)
+	}
+}
+
+func TestDecoderAnswersPing(t *testing.T) {
+	in := new(bytes.Buffer)
+	sent := time.Unix(0, 1234567890)
+
+	for _, p := range []Payload{&Ping{Seq: 9, Sent: sent}, stringPayload("Don't panic.")} {
+		_, err := p.WriteTo(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var answers []Payload
+	dec := NewDecoder(in, func(p Payload) error {
+		answers = append(answers, p)
+		return nil
+	})
+
+	p, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.String() != "Don't panic." {
+		t.Errorf("unexpected payload: %v", p)
+	}
+
+	if len(answers) != 1 {
+		t.Fatalf("expected 1 pong; actual: %d answers", len(answers))
+	}
+
+	pong, ok := answers[0].(*Pong)
+	if !ok || pong.Seq != 9 || !pong.Sent.Equal(sent) {
+		t.Errorf("expected pong 9 echoing the send time; actual: %#v", answers[0])
+	}
+}
+
+func TestDecoderMaxFrameSize(t *testing.T) {
+	in := new(bytes.Buffer)
+
+	for _, p := range []Payload{stringPayload("Don't panic."), stringPayload("Clear is better than clever.")} {
+		_, err := p.WriteTo(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dec := NewDecoder(in, func(Payload) error { return nil })
+	dec.MaxFrameSize = uint32(len("Don't panic."))
+
+	p, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.String() != "Don't panic." {
+		t.Errorf("unexpected payload: %v", p)
+	}
+
+	_, err = dec.Decode()
+	if err != ErrMaxPayloadSize {
+		t.Fatalf("expected ErrMaxPayloadSize; actual: %v", err)
+	}
+}
+
+func TestPayloadConnHeartbeat(t *testing.T) {
+	client, server := payloadConnPair(t)
+
+	hb := client.Heartbeat()
+	hb.Timeout = 50 * time.Millisecond
+	hb.MaxMisses = 2
+
+	// The client reads in the background so it sees the pongs.
+	go func() {
+		for {
+			_, err := client.Receive()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// While the server is reading, its Decoder answers the pings.
+	serving := make(chan struct{})
+
+	go func() {
+		defer close(serving)
+
+		for {
+			_, err := server.Receive()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	reset := make(chan time.Duration, 1)
+	reset <- 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err := hb.Run(ctx, reset)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected a live peer; actual: %v", err)
+	}
+
+	if client.RTT() <= 0 {
+		t.Error("expected pongs to be measured")
+	}
+
+	// Once the server stops reading, it stops answering.
+	_ = server.SetReadDeadline(time.Now())
+	<-serving
+
+	reset <- 10 * time.Millisecond
+
+	err = hb.Run(context.Background(), reset)
+	if !errors.Is(err, ch03.ErrHeartbeatTimeout) {
+		t.Errorf("expected ErrHeartbeatTimeout; actual: %v", err)
+	}
+}
@@ -0,0 +1,439 @@
+/*
+	Marshal and Unmarshal map Go values onto the TLV payloads so structs
+	don't have to be taken apart by hand. Structs become Records, with the
+	field IDs coming from struct tags:
+
+		type User struct {
+			Name  string   `tlv:"1"`
+			Email string   `tlv:"2,omitempty"`
+			Roles []string `tlv:"3"`
+			Temp  string   `tlv:"-"`
+		}
+
+	Untagged fields are ignored. Strings map to String, byte slices to
+	Binary, other slices and arrays to List. Integers and floats are stored
+	as 8-byte big-endian Binary values and bools as a single byte, whatever
+	their width in Go, so a field can be widened later without breaking old
+	messages. Unmarshal skips field IDs the target struct doesn't know, which
+	lets a newer peer add fields without breaking older ones.
+*/
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// UnmarshalTypeError describes a payload that can't be stored in the Go value
+// it's being unmarshaled into.
+type UnmarshalTypeError struct {
+	Payload Payload
+	Type    reflect.Type
+	Field   string // the struct field, if any
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("tlv: cannot unmarshal %T into field %s of type %s", e.Payload, e.Field, e.Type)
+	}
+
+	return fmt.Sprintf("tlv: cannot unmarshal %T into value of type %s", e.Payload, e.Type)
+}
+
+// Is lets callers check for ErrUnexpectedType with errors.Is.
+func (e *UnmarshalTypeError) Is(target error) bool { return target == ErrUnexpectedType }
+
+var (
+	ErrUnexpectedType  = errors.New("tlv: unexpected payload type")
+	ErrUnmarshalTarget = errors.New("tlv: Unmarshal requires a non-nil pointer")
+	ErrMarshalNil      = errors.New("tlv: cannot marshal nil")
+	ErrUnmarshalNil    = errors.New("tlv: cannot unmarshal a nil payload")
+
+	errMarshalDepth = fmt.Errorf("%w: nested more than %d deep", ErrInvalidContainer, MaxContainerDepth)
+)
+
+var payloadInterface = reflect.TypeOf((*Payload)(nil)).Elem()
+
+// Marshal returns the payload encoding of v. Values that already implement
+// Payload are returned as is. Nil, or a nil pointer, is an error that matches
+// ErrMarshalNil. Structs, slices and arrays nested more than
+// MaxContainerDepth deep, e.g. through a pointer cycle, are an error that
+// matches ErrInvalidContainer.
+func Marshal(v any) (Payload, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return nil, ErrMarshalNil
+	}
+
+	if p, ok := v.(Payload); ok {
+		if rv.Kind() == reflect.Pointer && rv.IsNil() {
+			return nil, ErrMarshalNil
+		}
+
+		return p, nil
+	}
+
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil, ErrMarshalNil
+		}
+
+		rv = rv.Elem()
+	}
+
+	// Work on an addressable copy so fields of Payload types, which have
+	// pointer receivers, are recognized as such.
+	if !rv.CanAddr() {
+		tmp := reflect.New(rv.Type()).Elem()
+		tmp.Set(rv)
+		rv = tmp
+	}
+
+	return marshalValue(rv, 0)
+}
+
+// marshalValue encodes v, which sits inside depth containers. Nesting is held
+// to MaxContainerDepth like it is when decoding, which also stops a pointer
+// cycle from recursing forever.
+func marshalValue(v reflect.Value, depth int) (Payload, error) {
+	if v.CanAddr() && v.Addr().Type().Implements(payloadInterface) {
+		return v.Addr().Interface().(Payload), nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s := String(v.String())
+		return &s, nil
+	case reflect.Bool:
+		b := Binary{0}
+		if v.Bool() {
+			b[0] = 1
+		}
+
+		return &b, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return marshalUint64(uint64(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return marshalUint64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return marshalUint64(math.Float64bits(v.Float())), nil
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make(Binary, v.Len())
+			reflect.Copy(reflect.ValueOf([]byte(b)), v)
+
+			return &b, nil
+		}
+
+		if depth >= MaxContainerDepth {
+			return nil, errMarshalDepth
+		}
+
+		l := make(List, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			p, err := marshalValue(indirect(v.Index(i)), depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			l = append(l, p)
+		}
+
+		return &l, nil
+	case reflect.Struct:
+		if depth >= MaxContainerDepth {
+			return nil, errMarshalDepth
+		}
+
+		return marshalStruct(v, depth)
+	case reflect.Interface:
+		if p, ok := v.Interface().(Payload); ok {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("tlv: unsupported type %s", v.Type())
+}
+
+func marshalStruct(v reflect.Value, depth int) (Payload, error) {
+	fields, err := cachedFields(v.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	rec := make(Record, 0, len(fields))
+
+	for _, f := range fields {
+		fv := v.Field(f.index)
+
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+
+		// There's no way to encode nil, so nil pointers are always left out.
+		if (fv.Kind() == reflect.Pointer || fv.Kind() == reflect.Interface) && fv.IsNil() {
+			continue
+		}
+
+		p, err := marshalValue(indirect(fv), depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+
+		rec = append(rec, Field{ID: f.id, Value: p})
+	}
+
+	return &rec, nil
+}
+
+func marshalUint64(u uint64) Payload {
+	b := make(Binary, 8)
+	binary.BigEndian.PutUint64(b, u)
+
+	return &b
+}
+
+// indirect follows pointers down to the value they point at.
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	return v
+}
+
+// Unmarshal stores p in the value pointed to by v. A nil payload, including
+// one inside a container, is an error that matches ErrUnmarshalNil.
+func Unmarshal(p Payload, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return ErrUnmarshalTarget
+	}
+
+	return unmarshalValue(p, rv.Elem(), "")
+}
+
+func unmarshalValue(p Payload, v reflect.Value, field string) error {
+	if rp := reflect.ValueOf(p); !rp.IsValid() || (rp.Kind() == reflect.Pointer && rp.IsNil()) {
+		if field != "" {
+			return fmt.Errorf("%w: field %s", ErrUnmarshalNil, field)
+		}
+
+		return ErrUnmarshalNil
+	}
+
+	mismatch := &UnmarshalTypeError{Payload: p, Type: v.Type(), Field: field}
+
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+
+		return unmarshalValue(p, v.Elem(), field)
+	}
+
+	if v.Kind() == reflect.Interface && v.Type() == payloadInterface {
+		v.Set(reflect.ValueOf(p))
+		return nil
+	}
+
+	// Payload types, e.g. a String or Binary field, take the value as is.
+	if v.Addr().Type().Implements(payloadInterface) {
+		if reflect.TypeOf(p) != v.Addr().Type() {
+			return mismatch
+		}
+
+		v.Set(reflect.ValueOf(p).Elem())
+
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := p.(*String)
+		if !ok {
+			return mismatch
+		}
+
+		v.SetString(string(*s))
+	case reflect.Bool:
+		b, ok := p.(*Binary)
+		if !ok || len(*b) != 1 {
+			return mismatch
+		}
+
+		v.SetBool((*b)[0] != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		u, ok := unmarshalUint64(p)
+		if !ok || v.OverflowInt(int64(u)) {
+			return mismatch
+		}
+
+		v.SetInt(int64(u))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, ok := unmarshalUint64(p)
+		if !ok || v.OverflowUint(u) {
+			return mismatch
+		}
+
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		u, ok := unmarshalUint64(p)
+		if !ok || v.OverflowFloat(math.Float64frombits(u)) {
+			return mismatch
+		}
+
+		v.SetFloat(math.Float64frombits(u))
+	case reflect.Slice, reflect.Array:
+		return unmarshalSequence(p, v, mismatch)
+	case reflect.Struct:
+		rec, ok := p.(*Record)
+		if !ok {
+			return mismatch
+		}
+
+		return unmarshalStruct(*rec, v)
+	default:
+		return fmt.Errorf("tlv: unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+func unmarshalSequence(p Payload, v reflect.Value, mismatch error) error {
+	if v.Type().Elem().Kind() == reflect.Uint8 {
+		b, ok := p.(*Binary)
+		if !ok {
+			return mismatch
+		}
+
+		if v.Kind() == reflect.Array {
+			if len(*b) != v.Len() {
+				return mismatch
+			}
+		} else {
+			v.Set(reflect.MakeSlice(v.Type(), len(*b), len(*b)))
+		}
+
+		reflect.Copy(v, reflect.ValueOf([]byte(*b)))
+
+		return nil
+	}
+
+	l, ok := p.(*List)
+	if !ok {
+		return mismatch
+	}
+
+	if v.Kind() == reflect.Array {
+		if len(*l) != v.Len() {
+			return mismatch
+		}
+	} else {
+		v.Set(reflect.MakeSlice(v.Type(), len(*l), len(*l)))
+	}
+
+	for i, item := range *l {
+		err := unmarshalValue(item, v.Index(i), "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unmarshalStruct(rec Record, v reflect.Value) error {
+	fields, err := cachedFields(v.Type())
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[uint16]structField, len(fields))
+	for _, f := range fields {
+		byID[f.id] = f
+	}
+
+	for _, rf := range rec {
+		f, ok := byID[rf.ID]
+		if !ok {
+			continue // a field from a newer version of the struct
+		}
+
+		err := unmarshalValue(rf.Value, v.Field(f.index), v.Type().Name()+"."+f.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unmarshalUint64(p Payload) (uint64, bool) {
+	b, ok := p.(*Binary)
+	if !ok || len(*b) != 8 {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint64(*b), true
+}
+
+type structField struct {
+	name      string
+	index     int
+	id        uint16
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // reflect.Type -> []structField
+
+// cachedFields parses the tlv tags of t once and caches the result.
+func cachedFields(t reflect.Type) ([]structField, error) {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]structField), nil
+	}
+
+	var (
+		fields []structField
+		seen   = make(map[uint16]string)
+	)
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+
+		tag, ok := sf.Tag.Lookup("tlv")
+		if !ok || tag == "-" || !sf.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+
+		id, err := strconv.ParseUint(name, 10, 16)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("tlv: %s.%s: invalid field ID %q", t.Name(), sf.Name, name)
+		}
+
+		if other, dup := seen[uint16(id)]; dup {
+			return nil, fmt.Errorf("tlv: %s: fields %s and %s share ID %d", t.Name(), other, sf.Name, id)
+		}
+
+		seen[uint16(id)] = sf.Name
+
+		fields = append(fields, structField{
+			name:      sf.Name,
+			index:     i,
+			id:        uint16(id),
+			omitEmpty: opts == "omitempty",
+		})
+	}
+
+	fieldCache.Store(t, fields)
+
+	return fields, nil
+}
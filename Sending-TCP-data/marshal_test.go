@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+type address struct {
+	Street string `tlv:"1"`
+	City   string `tlv:"2"`
+}
+
+type user struct {
+	ID       uint64            `tlv:"1"`
+	Name     string            `tlv:"2"`
+	Email    string            `tlv:"3,omitempty"`
+	Admin    bool              `tlv:"4"`
+	Score    float64           `tlv:"5"`
+	Balance  int32             `tlv:"6"`
+	Avatar   []byte            `tlv:"7,omitempty"`
+	Roles    []string          `tlv:"8"`
+	Address  *address          `tlv:"9"`
+	Previous []address         `tlv:"10,omitempty"`
+	Note     String            `tlv:"11"`
+	Extra    map[string]string // untagged, so ignored
+	Session  string            `tlv:"-"`
+}
+
+var testUser = user{
+	ID:      42,
+	Name:    "Gopher",
+	Admin:   true,
+	Score:   99.5,
+	Balance: -1200,
+	Avatar:  []byte{0xde, 0xad, 0xbe, 0xef},
+	Roles:   []string{"reader", "writer"},
+	Address: &address{Street: "1 Infinite Loop", City: "Cupertino"},
+	Previous: []address{
+		{Street: "221B Baker St", City: "London"},
+	},
+	Note: "Clear is better than clever.",
+}
+
+func TestMarshal(t *testing.T) {
+	expected := testUser
+	expected.Session = "not sent"
+	expected.Extra = map[string]string{"not": "sent"}
+
+	p, err := Marshal(&expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// round trip it through the wire format
+	buf := new(bytes.Buffer)
+	_, err = p.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual user
+	err = Unmarshal(p, &actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected.Session, expected.Extra = "", nil
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("value mismatch:\n%+v\n%+v", expected, actual)
+	}
+}
+
+func TestMarshalOmitEmpty(t *testing.T) {
+	p, err := Marshal(user{Name: "Gopher"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := *p.(*Record)
+
+	for _, id := range []uint16{3, 7, 9, 10} {
+		if _, ok := rec.Field(id); ok {
+			t.Errorf("expected field %d to be omitted", id)
+		}
+	}
+
+	// fields without omitempty are sent even when they're empty
+	if _, ok := rec.Field(1); !ok {
+		t.Error("expected field 1 to be present")
+	}
+}
+
+func TestUnmarshalUnknownFields(t *testing.T) {
+	name := String("Gopher")
+	future := String("added in a later version")
+
+	// field 99 and the frame type 200 are both unknown to this version
+	rec := Record{
+		{ID: 2, Value: &name},
+		{ID: 99, Value: &future},
+		{ID: 100, Value: &Unknown{Type: 200, Data: []byte("?")}},
+	}
+
+	buf := new(bytes.Buffer)
+	_, err := rec.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual user
+	err = Unmarshal(p, &actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual.Name != string(name) {
+		t.Errorf("expected name %q; actual %q", name, actual.Name)
+	}
+}
+
+func TestUnmarshalTypeMismatch(t *testing.T) {
+	name := Binary("not a string")
+	rec := Record{{ID: 2, Value: &name}}
+
+	var u user
+	err := Unmarshal(&rec, &u)
+
+	var typeErr *UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("expected *UnmarshalTypeError; actual: %v", err)
+	}
+
+	if typeErr.Field != "user.Name" {
+		t.Errorf("expected field user.Name; actual: %q", typeErr.Field)
+	}
+}
+
+func TestMarshalDepth(t *testing.T) {
+	type node struct {
+		Next *node `tlv:"1"`
+	}
+
+	cycle := &node{}
+	cycle.Next = cycle
+
+	_, err := Marshal(cycle)
+	if !errors.Is(err, ErrInvalidContainer) {
+		t.Fatalf("expected ErrInvalidContainer for a pointer cycle; actual: %v", err)
+	}
+
+	// As deep as decoding allows is fine.
+	chain := &node{}
+	for i := 1; i < MaxContainerDepth; i++ {
+		chain = &node{Next: chain}
+	}
+
+	p, err := Marshal(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+
+	_, err = p.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Marshal(&node{Next: chain})
+	if !errors.Is(err, ErrInvalidContainer) {
+		t.Errorf("expected ErrInvalidContainer one level deeper; actual: %v", err)
+	}
+}
+
+func TestUnmarshalFloat32Overflow(t *testing.T) {
+	var f float32
+
+	err := Unmarshal(marshalUint64(math.Float64bits(math.MaxFloat64)), &f)
+	if !errors.Is(err, ErrUnexpectedType) {
+		t.Fatalf("expected ErrUnexpectedType; actual: %v", err)
+	}
+
+	err = Unmarshal(marshalUint64(math.Float64bits(1.5)), &f)
+	if err != nil || f != 1.5 {
+		t.Fatalf("expected 1.5; actual: %v, %v", f, err)
+	}
+}
+
+func TestMarshalNil(t *testing.T) {
+	var (
+		u *user
+		b *Binary
+	)
+
+	for _, v := range []any{nil, u, b} {
+		_, err := Marshal(v)
+		if !errors.Is(err, ErrMarshalNil) {
+			t.Errorf("%T: expected ErrMarshalNil; actual: %v", v, err)
+		}
+	}
+
+	err := NewSender[Payload](new(bytes.Buffer)).Send(nil)
+	if !errors.Is(err, ErrMarshalNil) {
+		t.Errorf("Send: expected ErrMarshalNil; actual: %v", err)
+	}
+}
+
+func TestUnmarshalNil(t *testing.T) {
+	var (
+		p   Payload
+		str String
+		s   string
+		msg struct {
+			Body Payload `tlv:"1"`
+		}
+	)
+
+	for _, c := range []struct {
+		p Payload
+		v any
+	}{
+		{nil, &p},
+		{nil, &s},
+		{(*String)(nil), &str},
+		{&Record{{ID: 1, Value: nil}}, &msg},
+	} {
+		err := Unmarshal(c.p, c.v)
+		if !errors.Is(err, ErrUnmarshalNil) {
+			t.Errorf("%T into %T: expected ErrUnmarshalNil; actual: %v", c.p, c.v, err)
+		}
+	}
+}
+
+// nestedRecords returns a frame of levels Records, each the only field of the
+// one around it.
+func nestedRecords(levels int) []byte {
+	buf := new(bytes.Buffer)
+
+	for i := 0; i < levels; i++ {
+		buf.WriteByte(RecordType)
+		_ = binary.Write(buf, binary.BigEndian, uint32(7*(levels-1-i)))
+
+		if i < levels-1 {
+			_ = binary.Write(buf, binary.BigEndian, uint16(1))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func TestDecodeNestedContainers(t *testing.T) {
+	p, err := decode(bytes.NewReader(nestedRecords(MaxContainerDepth)))
+	if err != nil {
+		t.Fatalf("expected %d levels to decode; actual: %v", MaxContainerDepth, err)
+	}
+
+	for depth := 1; depth < MaxContainerDepth; depth++ {
+		inner, ok := (*p.(*Record)).Field(1)
+		if !ok {
+			t.Fatalf("expected a nested record at depth %d", depth)
+		}
+
+		p = inner
+	}
+
+	// About 210KB of nesting, which used to take gigabytes to reject.
+	frame := nestedRecords(30000)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	_, err = decode(bytes.NewReader(frame))
+
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, ErrInvalidContainer) {
+		t.Errorf("expected ErrInvalidContainer; actual: %v", err)
+	}
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4*uint64(len(frame)) {
+		t.Errorf("expected decoding to allocate about the frame size; actual: %d bytes", allocated)
+	}
+}
+
+func TestDecodeCompressedMembers(t *testing.T) {
+	member := func(size int) Payload {
+		b := Binary(make([]byte, size))
+		return &Compressed{Payload: &b}
+	}
+
+	buf := new(bytes.Buffer)
+	_, err := List{member(4 << 20), member(4 << 20)}.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := decode(buf)
+	if err != nil {
+		t.Fatalf("expected members inflating to 8MB to decode; actual: %v", err)
+	}
+
+	if l := *p.(*List); len(l) != 2 || len(l[1].Bytes()) != 4<<20 {
+		t.Errorf("expected two 4MB members; actual: %v", l)
+	}
+
+	// Each member is well under MaxPayloadSize, but together they're over it.
+	buf.Reset()
+	_, err = List{member(4 << 20), &Record{{ID: 1, Value: member(4 << 20)}}, member(4 << 20)}.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = decode(buf)
+	if !errors.Is(err, ErrMaxPayloadSize) {
+		t.Errorf("expected ErrMaxPayloadSize; actual: %v", err)
+	}
+}
+
+func TestDecodeRPCMembers(t *testing.T) {
+	compressed := func(size int) Payload {
+		b := Binary(make([]byte, size))
+		return &Compressed{Payload: &b}
+	}
+
+	// Response bodies draw on the same inflate budget as the record's other
+	// members.
+	buf := new(bytes.Buffer)
+	_, err := (&Record{
+		{ID: 1, Value: &Response{ID: 1, Body: compressed(4 << 20)}},
+		{ID: 2, Value: &Response{ID: 2, Body: compressed(4 << 20)}},
+		{ID: 3, Value: &Request{ID: 3, Method: "put", Body: compressed(4 << 20)}},
+	}).WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = decode(buf)
+	if !errors.Is(err, ErrMaxPayloadSize) {
+		t.Errorf("expected ErrMaxPayloadSize; actual: %v", err)
+	}
+
+	// Nor do they start counting the depth afresh.
+	p := Payload(binaryPayload("Don't panic."))
+	for i := 0; i < 200; i++ {
+		p = &Request{ID: uint32(i), Method: "nest", Body: &Record{{ID: 1, Value: p}}}
+	}
+
+	buf.Reset()
+	_, err = p.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = decode(buf)
+	if !errors.Is(err, ErrInvalidContainer) {
+		t.Errorf("expected ErrInvalidContainer; actual: %v", err)
+	}
+}
+
+func BenchmarkMarshalTLV(b *testing.B) {
+	buf := new(bytes.Buffer)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+
+		p, err := Marshal(&testUser)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_, err = p.WriteTo(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.SetBytes(int64(buf.Len()))
+}
+
+func BenchmarkMarshalGob(b *testing.B) {
+	buf := new(bytes.Buffer)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+
+		// A new encoder per message, since that's what a TLV message is:
+		// self-contained, with no type information shared between them.
+		err := gob.NewEncoder(buf).Encode(&testUser)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.SetBytes(int64(buf.Len()))
+}
+
+func BenchmarkUnmarshalTLV(b *testing.B) {
+	p, err := Marshal(&testUser)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	encoded := new(bytes.Buffer)
+	_, err = p.WriteTo(encoded)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(encoded.Len()))
+
+	for i := 0; i < b.N; i++ {
+		p, err := decode(bytes.NewReader(encoded.Bytes()))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		var u user
+		err = Unmarshal(p, &u)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalGob(b *testing.B) {
+	encoded := new(bytes.Buffer)
+	err := gob.NewEncoder(encoded).Encode(&testUser)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(encoded.Len()))
+
+	for i := 0; i < b.N; i++ {
+		var u user
+		err := gob.NewDecoder(bytes.NewReader(encoded.Bytes())).Decode(&u)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,808 @@
+/*
+	A yamux-style stream multiplexer. A MuxSession carries any number of
+	logical streams over one connection, each of which is a net.Conn in its
+	own right. Everything on the wire is a MuxFrame, an ordinary TLV frame
+	whose body is a 1-byte kind, a 4-byte stream ID and the data.
+
+	Flow control is per stream. The receiver advertises a window (how much
+	it's willing to buffer) and the sender never has more than that in
+	flight. As the application reads, the receiver hands the space back with
+	window update frames. A stream that isn't being read therefore stalls
+	only itself, never the session.
+
+	Either side can open streams. The client uses odd stream IDs and the
+	server even ones, so they never collide, and each side opens its
+	streams in increasing ID order so an ID is never used twice.
+*/
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	muxOpen   uint8 = iota + 1 // open a new stream
+	muxData                    // stream data
+	muxWindow                  // 4-byte window increment
+	muxClose                   // sender won't write any more
+	muxReset                   // abort the stream in both directions
+	muxPing                    // 4-byte keepalive token
+	muxPong                    // echoes a ping's token
+)
+
+const (
+	DefaultMuxWindow = 256 << 10 // 256KB
+	muxMaxChunk      = 16 << 10  // largest data frame we send
+	muxControlQueue  = 64        // control frames waiting to be written
+)
+
+var (
+	ErrMuxSessionClosed  = errors.New("mux: session closed")
+	ErrMuxStreamClosed   = errors.New("mux: stream closed")
+	ErrMuxStreamReset    = errors.New("mux: stream reset by peer")
+	ErrMuxKeepAlive      = errors.New("mux: keepalive timeout")
+	ErrMuxProtocol       = errors.New("mux: protocol error")
+	errMuxFrameTooShort  = fmt.Errorf("%w: frame too short", ErrMuxProtocol)
+	errMuxWindowExceeded = fmt.Errorf("%w: receive window exceeded", ErrMuxProtocol)
+	errMuxControlBacklog = errors.New("mux: peer isn't reading control frames")
+)
+
+// MuxFrame is the single frame type used by the multiplexer.
+type MuxFrame struct {
+	Kind   uint8
+	Stream uint32
+	Data   []byte
+}
+
+func (m MuxFrame) Bytes() []byte { return m.Data }
+
+func (m MuxFrame) String() string {
+	return fmt.Sprintf("mux kind %d stream %d (%d bytes)", m.Kind, m.Stream, len(m.Data))
+}
+
+func (m MuxFrame) WriteTo(w io.Writer) (int64, error) {
+	body := make([]byte, 5+len(m.Data))
+	body[0] = m.Kind
+	binary.BigEndian.PutUint32(body[1:], m.Stream)
+	copy(body[5:], m.Data)
+
+	return writeFrame(w, MuxType, body)
+}
+
+func (m *MuxFrame) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	if err != nil {
+		return n, err
+	}
+
+	if len(body) < 5 {
+		return n, errMuxFrameTooShort
+	}
+
+	m.Kind = body[0]
+	m.Stream = binary.BigEndian.Uint32(body[1:])
+	m.Data = body[5:]
+
+	return n, nil
+}
+
+// MuxConfig tunes a session. The zero value, or a nil *MuxConfig, uses the
+// defaults noted on each field.
+type MuxConfig struct {
+	Window            uint32        // per-stream receive window; default DefaultMuxWindow
+	AcceptBacklog     int           // streams waiting on Accept; default 64
+	KeepAliveInterval time.Duration // time between pings; default 30s, < 0 disables
+	KeepAliveTimeout  time.Duration // time to wait for a pong; default 10s
+}
+
+func (c *MuxConfig) withDefaults() MuxConfig {
+	var cfg MuxConfig
+	if c != nil {
+		cfg = *c
+	}
+
+	if cfg.Window == 0 {
+		cfg.Window = DefaultMuxWindow
+	}
+
+	if cfg.AcceptBacklog <= 0 {
+		cfg.AcceptBacklog = 64
+	}
+
+	if cfg.KeepAliveInterval == 0 {
+		cfg.KeepAliveInterval = 30 * time.Second
+	}
+
+	if cfg.KeepAliveTimeout <= 0 {
+		cfg.KeepAliveTimeout = 10 * time.Second
+	}
+
+	return cfg
+}
+
+// MuxSession multiplexes streams over a single connection. It implements
+// net.Listener, so the streams the peer opens can be handed to anything
+// that serves a listener.
+type MuxSession struct {
+	conn   net.Conn
+	cfg    MuxConfig
+	parity uint32 // of the IDs this side opens; set once, so read without mu
+
+	wmu    sync.Mutex // serializes frame writes
+	openMu sync.Mutex // keeps the open frames we send in ID order
+
+	mu       sync.Mutex
+	streams  map[uint32]*MuxStream
+	nextID   uint32
+	remoteID uint32 // highest stream ID the peer has opened
+	pings    map[uint32]chan struct{}
+	pingID   uint32
+	err      error
+
+	accept  chan *MuxStream
+	control chan Payload
+	done    chan struct{}
+}
+
+// NewMuxClient starts a session on the dialing side of conn.
+func NewMuxClient(conn net.Conn, cfg *MuxConfig) *MuxSession {
+	return newMuxSession(conn, cfg, 1)
+}
+
+// NewMuxServer starts a session on the accepting side of conn.
+func NewMuxServer(conn net.Conn, cfg *MuxConfig) *MuxSession {
+	return newMuxSession(conn, cfg, 2)
+}
+
+func newMuxSession(conn net.Conn, cfg *MuxConfig, firstID uint32) *MuxSession {
+	s := &MuxSession{
+		conn:    conn,
+		cfg:     cfg.withDefaults(),
+		parity:  firstID % 2,
+		streams: make(map[uint32]*MuxStream),
+		nextID:  firstID,
+		pings:   make(map[uint32]chan struct{}),
+		control: make(chan Payload, muxControlQueue),
+		done:    make(chan struct{}),
+	}
+
+	s.accept = make(chan *MuxStream, s.cfg.AcceptBacklog)
+
+	go s.recvLoop()
+	go s.controlLoop()
+
+	if s.cfg.KeepAliveInterval > 0 {
+		go s.keepAlive()
+	}
+
+	return s
+}
+
+// Open starts a new stream. The peer picks it up with Accept.
+func (s *MuxSession) Open() (*MuxStream, error) {
+	// The peer only accepts IDs higher than any it's seen, so the ID is
+	// taken and sent in one go.
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+
+	s.mu.Lock()
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+
+		return nil, err
+	}
+
+	id := s.nextID
+	s.nextID += 2
+
+	st := newMuxStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	err := s.writeFrame(muxOpen, id, nil)
+	if err != nil {
+		s.forget(id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Accept waits for the peer to open a stream.
+func (s *MuxSession) Accept() (net.Conn, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.closeErr()
+	}
+}
+
+// Addr returns the local address of the underlying connection.
+func (s *MuxSession) Addr() net.Addr { return s.conn.LocalAddr() }
+
+// Close closes the session and every stream on it.
+func (s *MuxSession) Close() error {
+	s.shutdown(ErrMuxSessionClosed)
+	return nil
+}
+
+// Done is closed once the session has shut down. Err reports why.
+func (s *MuxSession) Done() <-chan struct{} { return s.done }
+
+func (s *MuxSession) Err() error {
+	select {
+	case <-s.done:
+		return s.closeErr()
+	default:
+		return nil
+	}
+}
+
+// Ping sends a ping and waits for the pong, returning the round trip time.
+func (s *MuxSession) Ping() (time.Duration, error) {
+	pong := make(chan struct{})
+
+	s.mu.Lock()
+	s.pingID++
+	id := s.pingID
+	s.pings[id] = pong
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	token := make([]byte, 4)
+	binary.BigEndian.PutUint32(token, id)
+
+	start := time.Now()
+
+	// Write in the background so a peer that's stopped reading can't stall
+	// us past the keepalive timeout.
+	errs := make(chan error, 1)
+	go func() { errs <- s.writeFrame(muxPing, 0, token) }()
+
+	timer := time.NewTimer(s.cfg.KeepAliveTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case err := <-errs:
+			if err != nil {
+				return 0, err
+			}
+		case <-pong:
+			return time.Since(start), nil
+		case <-timer.C:
+			return 0, ErrMuxKeepAlive
+		case <-s.done:
+			return 0, s.closeErr()
+		}
+	}
+}
+
+func (s *MuxSession) keepAlive() {
+	ticker := time.NewTicker(s.cfg.KeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, err := s.Ping()
+			if err == ErrMuxKeepAlive {
+				s.shutdown(err)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *MuxSession) recvLoop() {
+	// Heartbeat frames from a PayloadConn pinger are answered too, through
+	// the control queue like muxPing.
+	dec := NewDecoder(s.conn, s.queueControl)
+
+	for {
+		p, err := dec.Decode()
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+
+		f, ok := p.(*MuxFrame)
+		if !ok {
+			s.shutdown(fmt.Errorf("%w: unexpected %T", ErrMuxProtocol, p))
+			return
+		}
+
+		err = s.handleFrame(f)
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+	}
+}
+
+func (s *MuxSession) handleFrame(f *MuxFrame) error {
+	switch f.Kind {
+	case muxPing:
+		return s.queueControl(&MuxFrame{Kind: muxPong, Data: f.Data})
+	case muxPong:
+		if len(f.Data) != 4 {
+			return errMuxFrameTooShort
+		}
+
+		s.mu.Lock()
+		pong, ok := s.pings[binary.BigEndian.Uint32(f.Data)]
+		delete(s.pings, binary.BigEndian.Uint32(f.Data))
+		s.mu.Unlock()
+
+		if ok {
+			close(pong)
+		}
+
+		return nil
+	case muxOpen:
+		return s.handleOpen(f.Stream)
+	}
+
+	s.mu.Lock()
+	st, ok := s.streams[f.Stream]
+	s.mu.Unlock()
+
+	// Data for a stream that's gone, e.g. one we've reset, is refused with a
+	// reset so the sender's writes fail rather than waiting forever on a
+	// window nobody will hand back. Anything else for such a stream is
+	// dropped; in particular a reset is never answered with another.
+	if !ok {
+		if f.Kind == muxData {
+			return s.refuse(f.Stream)
+		}
+
+		return nil
+	}
+
+	switch f.Kind {
+	case muxData:
+		accepted, err := st.receive(f.Data)
+		if err == nil && !accepted {
+			st.abort(ErrMuxStreamClosed)
+			s.forget(f.Stream)
+			err = s.refuse(f.Stream)
+		}
+
+		return err
+	case muxWindow:
+		if len(f.Data) != 4 {
+			return errMuxFrameTooShort
+		}
+
+		st.grow(binary.BigEndian.Uint32(f.Data))
+	case muxClose:
+		st.remoteClose()
+	case muxReset:
+		st.abort(ErrMuxStreamReset)
+		s.forget(f.Stream)
+	default:
+		return fmt.Errorf("%w: unknown frame kind %d", ErrMuxProtocol, f.Kind)
+	}
+
+	return nil
+}
+
+func (s *MuxSession) handleOpen(id uint32) error {
+	// The peer must use its own half of the ID space.
+	if id%2 == s.parity {
+		return fmt.Errorf("%w: stream %d has the wrong parity", ErrMuxProtocol, id)
+	}
+
+	// It opens streams in ID order, so an ID that isn't higher than the
+	// last one has already been used, even if that stream has since closed.
+	s.mu.Lock()
+	if id <= s.remoteID {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: stream %d already used", ErrMuxProtocol, id)
+	}
+
+	s.remoteID = id
+	st := newMuxStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- st:
+	default:
+		s.forget(id)
+		return s.refuse(id)
+	}
+
+	return nil
+}
+
+// refuse resets stream id on the peer.
+func (s *MuxSession) refuse(id uint32) error {
+	return s.queueControl(&MuxFrame{Kind: muxReset, Stream: id})
+}
+
+// queueControl hands a frame the receive loop wants sent, i.e. a pong or a
+// reset, to the control writer, so the loop is never stuck behind a peer
+// that isn't reading. A peer that lets the queue fill up has stopped reading
+// altogether, and the error returned shuts the session down.
+func (s *MuxSession) queueControl(p Payload) error {
+	select {
+	case s.control <- p:
+		return nil
+	default:
+		return errMuxControlBacklog
+	}
+}
+
+func (s *MuxSession) controlLoop() {
+	for {
+		select {
+		case p := <-s.control:
+			// A failed write means the connection is gone, which the
+			// receive loop finds out for itself.
+			_ = s.writePayload(p)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *MuxSession) writeFrame(kind uint8, id uint32, data []byte) error {
+	return s.writePayload(&MuxFrame{Kind: kind, Stream: id, Data: data})
+}
+
+func (s *MuxSession) writePayload(p Payload) error {
+	select {
+	case <-s.done:
+		return s.closeErr()
+	default:
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	_, err := p.WriteTo(s.conn)
+
+	return err
+}
+
+func (s *MuxSession) forget(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *MuxSession) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *MuxSession) shutdown(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+
+	if err == io.EOF {
+		err = ErrMuxSessionClosed
+	}
+
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*MuxStream)
+	s.mu.Unlock()
+
+	close(s.done)
+	_ = s.conn.Close()
+
+	for _, st := range streams {
+		st.abort(err)
+	}
+}
+
+// MuxStream is a single logical stream. It implements net.Conn.
+type MuxStream struct {
+	id uint32
+	s  *MuxSession
+
+	mu            sync.Mutex
+	buf           []byte // received but not yet read
+	recvAvail     uint32 // how much more the peer may send us
+	unacked       uint32 // read by the application but not yet handed back
+	sendWindow    uint32 // how much more we may send
+	localClosed   bool
+	remoteClosed  bool
+	err           error // set on reset or session shutdown
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readable chan struct{} // signalled when there's data, EOF or an error
+	writable chan struct{} // signalled when the window grows
+}
+
+func newMuxStream(s *MuxSession, id uint32) *MuxStream {
+	return &MuxStream{
+		id:         id,
+		s:          s,
+		recvAvail:  s.cfg.Window,
+		sendWindow: s.cfg.Window,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream's ID within its session.
+func (st *MuxStream) ID() uint32 { return st.id }
+
+func (st *MuxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+
+		switch {
+		case len(st.buf) > 0:
+			n := copy(p, st.buf)
+			st.buf = st.buf[n:]
+			st.unacked += uint32(n)
+
+			// Hand the space back in batches rather than after every read.
+			var credit uint32
+			if st.unacked >= st.s.cfg.Window/2 && !st.remoteClosed {
+				credit, st.unacked = st.unacked, 0
+				st.recvAvail += credit
+			}
+			st.mu.Unlock()
+
+			if credit > 0 {
+				delta := make([]byte, 4)
+				binary.BigEndian.PutUint32(delta, credit)
+				_ = st.s.writeFrame(muxWindow, st.id, delta)
+			}
+
+			return n, nil
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+
+			return 0, err
+		case st.localClosed:
+			st.mu.Unlock()
+			return 0, ErrMuxStreamClosed
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		err := wait(st.readable, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *MuxStream) Write(p []byte) (int, error) {
+	var written int
+
+	for written < len(p) {
+		st.mu.Lock()
+
+		switch {
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+
+			return written, err
+		case st.localClosed:
+			st.mu.Unlock()
+			return written, ErrMuxStreamClosed
+		}
+
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+
+			err := wait(st.writable, deadline)
+			if err != nil {
+				return written, err
+			}
+
+			continue
+		}
+
+		chunk := len(p) - written
+		if chunk > muxMaxChunk {
+			chunk = muxMaxChunk
+		}
+
+		if uint32(chunk) > st.sendWindow {
+			chunk = int(st.sendWindow)
+		}
+
+		st.sendWindow -= uint32(chunk)
+		st.mu.Unlock()
+
+		err := st.s.writeFrame(muxData, st.id, p[written:written+chunk])
+		if err != nil {
+			return written, err
+		}
+
+		written += chunk
+	}
+
+	return written, nil
+}
+
+// Close tells the peer we're done writing and releases the stream. The peer
+// reads io.EOF once it has drained what we sent. The stream stays registered
+// until the peer closes its side too, so that if the peer keeps writing, it
+// is reset instead of being left blocked on its window.
+func (st *MuxStream) Close() error {
+	st.mu.Lock()
+	if st.localClosed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+
+	st.localClosed = true
+	done := st.remoteClosed
+	st.mu.Unlock()
+
+	notify(st.readable)
+	notify(st.writable)
+
+	if done {
+		st.s.forget(st.id)
+	}
+
+	return st.s.writeFrame(muxClose, st.id, nil)
+}
+
+// Reset aborts the stream in both directions. Unlike Close, data still in
+// flight is discarded and the peer's reads fail with ErrMuxStreamReset.
+func (st *MuxStream) Reset() error {
+	st.abort(ErrMuxStreamClosed)
+	st.s.forget(st.id)
+
+	return st.s.writeFrame(muxReset, st.id, nil)
+}
+
+func (st *MuxStream) LocalAddr() net.Addr { return st.s.conn.LocalAddr() }
+
+func (st *MuxStream) RemoteAddr() net.Addr { return st.s.conn.RemoteAddr() }
+
+func (st *MuxStream) SetDeadline(t time.Time) error {
+	_ = st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *MuxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+
+	// wake up a blocked Read so it picks up the new deadline
+	notify(st.readable)
+
+	return nil
+}
+
+func (st *MuxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+
+	notify(st.writable)
+
+	return nil
+}
+
+// receive buffers data from the peer, reporting false if nobody will ever
+// read it because the stream is closed on our side. Sending more than the
+// window allows is a protocol violation that takes the whole session down.
+func (st *MuxStream) receive(data []byte) (bool, error) {
+	st.mu.Lock()
+
+	if uint32(len(data)) > st.recvAvail {
+		st.mu.Unlock()
+		return false, errMuxWindowExceeded
+	}
+
+	st.recvAvail -= uint32(len(data))
+
+	if st.localClosed || st.err != nil {
+		st.mu.Unlock()
+		return false, nil
+	}
+
+	st.buf = append(st.buf, data...)
+	st.mu.Unlock()
+
+	notify(st.readable)
+
+	return true, nil
+}
+
+func (st *MuxStream) grow(delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+
+	notify(st.writable)
+}
+
+func (st *MuxStream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.mu.Unlock()
+
+	if done {
+		st.s.forget(st.id)
+	}
+
+	notify(st.readable)
+}
+
+func (st *MuxStream) abort(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+
+	notify(st.readable)
+	notify(st.writable)
+}
+
+// notify does a non-blocking send on a 1-buffered channel. A pending signal is
+// as good as two, since waiters recheck the stream's state anyway.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is signalled or the deadline passes.
+func wait(ch <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// muxPair returns a client and server session over a loopback connection.
+func muxPair(t *testing.T, cfg *MuxConfig) (*MuxSession, *MuxSession) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := NewMuxClient(conn, cfg), NewMuxServer(<-accepted, cfg)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+func TestMuxStreams(t *testing.T) {
+	// A small window makes every stream go through several window updates.
+	client, server := muxPair(t, &MuxConfig{Window: 32 << 10})
+
+	// server echoes everything back on each stream
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(c net.Conn) {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}(conn)
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			stream, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			defer stream.Close()
+
+			payload := make([]byte, 1<<20)
+			_, _ = rand.Read(payload)
+
+			go func() { _, _ = stream.Write(payload) }()
+
+			actual := make([]byte, len(payload))
+			_, err = io.ReadFull(stream, actual)
+			if err != nil {
+				t.Errorf("stream %d: %v", stream.ID(), err)
+				return
+			}
+
+			if !bytes.Equal(payload, actual) {
+				t.Errorf("stream %d: payload mismatch", stream.ID())
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestMuxServerOpen(t *testing.T) {
+	client, server := muxPair(t, nil)
+
+	stream, err := server.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stream.ID()%2 != 0 {
+		t.Errorf("expected an even stream ID from the server; actual: %d", stream.ID())
+	}
+
+	msg := []byte("Clear is better than clever.")
+	_, err = stream.Write(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = stream.Close()
+
+	conn, err := client.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(msg, actual) {
+		t.Errorf("expected %q; actual %q", msg, actual)
+	}
+}
+
+func TestMuxStreamReset(t *testing.T) {
+	client, server := muxPair(t, nil)
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = stream.Reset()
+
+	_, err = conn.Read(make([]byte, 1))
+	if err != ErrMuxStreamReset {
+		t.Fatalf("expected ErrMuxStreamReset; actual: %v", err)
+	}
+}
+
+func TestMuxWriteAfterPeerClose(t *testing.T) {
+	client, server := muxPair(t, &MuxConfig{Window: 32 << 10})
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = stream.Write([]byte("bye"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = stream.Close()
+
+	conn, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+
+	// More than the window, so the write can't finish without the closed
+	// side handing space back.
+	_, err = conn.Write(make([]byte, 64<<10))
+	if err != ErrMuxStreamReset {
+		t.Fatalf("expected ErrMuxStreamReset; actual: %v", err)
+	}
+
+	// What was sent before the Close still arrives.
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "bye" {
+		t.Errorf("expected to read bye; actual: %q, %v", buf, err)
+	}
+
+	client.mu.Lock()
+	_, open := client.streams[stream.ID()]
+	client.mu.Unlock()
+
+	if open {
+		t.Error("expected the reset stream to be released")
+	}
+}
+
+func TestMuxStreamDeadline(t *testing.T) {
+	client, _ := muxPair(t, nil)
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = stream.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = stream.Read(make([]byte, 1))
+	nErr, ok := err.(net.Error)
+	if !ok || !nErr.Timeout() {
+		t.Fatalf("expected timeout error; actual: %v", err)
+	}
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected os.ErrDeadlineExceeded; actual: %v", err)
+	}
+}
+
+func TestMuxKeepAlive(t *testing.T) {
+	client, _ := muxPair(t, &MuxConfig{
+		KeepAliveInterval: 50 * time.Millisecond,
+		KeepAliveTimeout:  100 * time.Millisecond,
+	})
+
+	rtt, err := client.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("rtt: %s", rtt)
+
+	// A peer that's alive keeps the session up.
+	time.Sleep(300 * time.Millisecond)
+	if err := client.Err(); err != nil {
+		t.Fatalf("unexpected session error: %v", err)
+	}
+
+	// A peer that reads our frames but never answers them is dead as far
+	// as the session is concerned.
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+
+	client = NewMuxClient(conn, &MuxConfig{
+		KeepAliveInterval: 50 * time.Millisecond,
+		KeepAliveTimeout:  100 * time.Millisecond,
+	})
+
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("session did not time out")
+	}
+
+	if err := client.Err(); err != ErrMuxKeepAlive {
+		t.Fatalf("expected ErrMuxKeepAlive; actual: %v", err)
+	}
+}
+
+func TestMuxAnswersHeartbeats(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	session := NewMuxServer(conn, &MuxConfig{KeepAliveInterval: -1})
+	defer session.Close()
+
+	_, err := (&Ping{Seq: 3, Sent: time.Now()}).WriteTo(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := decode(peer)
+	if pong, ok := p.(*Pong); err != nil || !ok || pong.Seq != 3 {
+		t.Fatalf("expected pong 3; actual: %v, %v", p, err)
+	}
+
+	if err := session.Err(); err != nil {
+		t.Errorf("expected the session to stay up; actual: %v", err)
+	}
+}
+
+func TestMuxStreamIDReuse(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	session := NewMuxServer(conn, &MuxConfig{KeepAliveInterval: -1})
+	defer session.Close()
+
+	// Open stream 3, reset it, then try opening it again.
+	for _, f := range []MuxFrame{{Kind: muxOpen, Stream: 3}, {Kind: muxReset, Stream: 3}, {Kind: muxOpen, Stream: 3}} {
+		_, err := f.WriteTo(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	<-session.Done()
+
+	if err := session.Err(); !errors.Is(err, ErrMuxProtocol) {
+		t.Errorf("expected a protocol error; actual: %v", err)
+	}
+}
+
+func TestMuxControlBacklog(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	session := NewMuxServer(conn, &MuxConfig{KeepAliveInterval: -1})
+	defer session.Close()
+
+	// The peer pings away but never reads a pong, so they pile up in the
+	// control queue until the session gives up on it.
+	go func() {
+		for {
+			_, err := (MuxFrame{Kind: muxPing, Data: []byte{0, 0, 0, 1}}).WriteTo(peer)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to shut down")
+	}
+
+	if err := session.Err(); err != errMuxControlBacklog {
+		t.Errorf("expected errMuxControlBacklog; actual: %v", err)
+	}
+}
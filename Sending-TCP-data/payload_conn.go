@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	ch03 "practice/network_programming/TCP"
+	tlsutil "practice/network_programming/TLS"
+)
+
+// PayloadConn sends and receives Payloads over any net.Conn, including a
+// *tls.Conn, so the same framing works in plaintext and over TLS. Send is
+// safe for concurrent use; Receive isn't. Heartbeats are handled by Receive
+// and never returned, so either side can run Ping at any time.
+type PayloadConn struct {
+	net.Conn
+
+	wmu sync.Mutex
+	dec *Decoder
+}
+
+func NewPayloadConn(conn net.Conn) *PayloadConn {
+	c := &PayloadConn{Conn: conn}
+	c.dec = NewDecoder(conn, c.Send)
+
+	return c
+}
+
+// DialPayloadTLS dials address over TLS. On the server side, accept from
+// tls.Listen or tls.NewListener and wrap the conns with NewPayloadConn.
+func DialPayloadTLS(network, address string, cfg *tls.Config) (*PayloadConn, error) {
+	conn, err := tlsutil.DialContext(context.Background(), network, address, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPayloadConn(conn), nil
+}
+
+func (c *PayloadConn) Send(p Payload) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	_, err := p.WriteTo(c.Conn)
+
+	return err
+}
+
+func (c *PayloadConn) Receive() (Payload, error) {
+	return c.dec.Decode()
+}
+
+// Ping sends heartbeats until ctx is canceled; see FramedPinger. The
+// round-trip times are measured as Receive reads the pongs.
+func (c *PayloadConn) Ping(ctx context.Context, reset <-chan time.Duration) {
+	FramedPinger(ctx, c.Send, reset)
+}
+
+// RTT returns the last round-trip time measured by Ping.
+func (c *PayloadConn) RTT() time.Duration {
+	return c.dec.RTT()
+}
+
+// Heartbeat returns a dead-peer detector for c: it sends Ping frames, and
+// Receive reports the pongs to it. Call Run on it instead of Ping, and keep
+// calling Receive so the pongs are seen. It must be called before the first
+// Receive.
+func (c *PayloadConn) Heartbeat() *ch03.Heartbeat {
+	hb := ch03.NewHeartbeat(c, pingSender(c.Send))
+	c.dec.OnPong = func(Pong) { hb.Pong() }
+
+	return hb
+}
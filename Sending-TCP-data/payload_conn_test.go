@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	ch03 "practice/network_programming/TCP"
+	tlsutil "practice/network_programming/TLS"
+)
+
+func testCerts(t *testing.T) (*tlsutil.CA, tls.Certificate, tls.Certificate) {
+	t.Helper()
+
+	ca, err := tlsutil.NewTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert, err := ca.Issue("localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCert, err := ca.Issue("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ca, serverCert, clientCert
+}
+
+func TestPayloadConnTLS(t *testing.T) {
+	ca, serverCert, clientCert := testCerts(t)
+
+	sPipe, cPipe := net.Pipe()
+	server := NewPayloadConn(tls.Server(sPipe, tlsutil.ServerConfig(serverCert, ca.Pool())))
+	client := NewPayloadConn(tls.Client(cPipe, tlsutil.ClientConfig(ca.Pool(), "localhost", &clientCert)))
+
+	b1 := Binary("Clear is better than clever.")
+	s1 := String("Errors are values.")
+	payloads := []Payload{&b1, &s1}
+
+	go func() {
+		defer sPipe.Close()
+
+		for _, p := range payloads {
+			err := server.Send(p)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	defer client.Close()
+
+	for _, expected := range payloads {
+		actual, err := client.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("value mismatch: %v != %v", expected, actual)
+		}
+	}
+
+	state := client.Conn.(*tls.Conn).ConnectionState()
+	if len(state.PeerCertificates) == 0 || state.PeerCertificates[0].Subject.CommonName != "localhost" {
+		t.Error("expected to be talking to the TLS server")
+	}
+}
+
+func TestProxyConnTLS(t *testing.T) {
+	ca, serverCert, clientCert := testCerts(t)
+
+	// source speaks TLS and sends a message, destination is a plaintext
+	// echo server; the proxy sits between them
+	source, err := tls.Listen("tcp", "127.0.0.1:", tlsutil.ServerConfig(serverCert, ca.Pool()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer source.Close()
+
+	destination, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer destination.Close()
+
+	go func() {
+		conn, err := destination.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	reply := make(chan Payload, 1)
+	go func() {
+		conn, err := source.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		s := String("Don't panic.")
+		_, err = s.WriteTo(conn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		p, err := decode(conn)
+		if err != nil {
+			t.Error(err)
+		}
+
+		reply <- p
+	}()
+
+	// Both of the proxy's dials show up in the trace.
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+
+	record := func(event string) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}
+
+	ctx := ch03.WithDialTrace(context.Background(), &ch03.DialTrace{
+		ConnectDone: func(_, address string, err error) {
+			record("connect " + address)
+		},
+		TLSHandshakeStart: func() { record("tls start") },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			record(fmt.Sprintf("tls done %t", state.HandshakeComplete))
+		},
+	})
+
+	go func() {
+		_ = proxyConnContext(ctx, source.Addr().String(), destination.Addr().String(),
+			tlsutil.ClientConfig(ca.Pool(), "localhost", &clientCert), nil)
+	}()
+
+	if p := <-reply; p == nil || p.String() != "Don't panic." {
+		t.Fatalf("expected the message echoed back through the proxy; actual: %v", p)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	expected := []string{
+		"connect " + source.Addr().String(),
+		"tls start",
+		"tls done true",
+		"connect " + destination.Addr().String(),
+	}
+
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected trace %q; actual: %q", expected, events)
+	}
+}
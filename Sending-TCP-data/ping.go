@@ -1,17 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
+
+	ch03 "practice/network_programming/TCP"
 )
 
 var (
 	count    = flag.Int("c", 3, "number of pings: <= 0 means forever")
 	interval = flag.Duration("i", time.Second, "interval between pings")
 	timeout  = flag.Duration("W", 5*time.Second, "time to wait for a reply")
+	retries  = flag.Int("r", 1, "dial attempts per ping, with backoff between them")
+	trace    = flag.Bool("t", false, "show DNS and connect timings for each ping")
 )
 
 func init() {
@@ -37,19 +44,35 @@ func main() {
 		fmt.Println("CTRL+C to stop...")
 	}
 
+	dialer := ch03.NewRetryDialer()
+	dialer.MaxAttempts = *retries
+
 	msg := 0
 
 	for (*count <= 0) || (msg < *count) {
 		msg++
 		fmt.Print(msg, " ")
 
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+
+		var tr *pingTrace
+		if *trace {
+			tr = newPingTrace()
+			ctx = ch03.WithDialTrace(ctx, tr.DialTrace())
+		}
+
 		start := time.Now()
-		c, err := net.DialTimeout("tcp", target, *timeout)
+		c, err := dialer.DialContext(ctx, "tcp", target)
 		dur := time.Since(start)
+		timedOut := ctx.Err() != nil
+		cancel()
 
 		if err != nil {
 			fmt.Printf("fail in %s: %v\n", dur, err)
-			if nErr, ok := err.(net.Error); !ok || !nErr.Temporary() {
+
+			// Refused, unreachable and timed out targets may come back, so
+			// keep pinging; anything else, like an unknown host, won't.
+			if !timedOut && ch03.ClassifyDialError(err) == ch03.ClassOther {
 				os.Exit(1)
 			}
 		} else {
@@ -57,6 +80,76 @@ func main() {
 			fmt.Println(dur)
 		}
 
+		if tr != nil {
+			for _, step := range tr.Steps() {
+				fmt.Println("   ", step)
+			}
+		}
+
 		time.Sleep(*interval)
 	}
 }
+
+// pingTrace collects a description of each step of a dial. Its hooks may run
+// from several goroutines at once, and losing connect attempts can still
+// report in after the dial has returned, so everything is guarded by mu.
+type pingTrace struct {
+	mu       sync.Mutex
+	dnsStart time.Time
+	connects map[string]time.Time // connect start times by address
+	steps    []string
+}
+
+func newPingTrace() *pingTrace {
+	return &pingTrace{connects: make(map[string]time.Time)}
+}
+
+// Steps returns a copy of the steps described so far.
+func (p *pingTrace) Steps() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.steps...)
+}
+
+func (p *pingTrace) DialTrace() *ch03.DialTrace {
+	return &ch03.DialTrace{
+		DNSStart: func(string) {
+			p.mu.Lock()
+			p.dnsStart = time.Now()
+			p.mu.Unlock()
+		},
+		DNSDone: func(addrs []net.IPAddr, err error) {
+			ips := make([]string, len(addrs))
+			for i, addr := range addrs {
+				ips[i] = addr.String()
+			}
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+
+			step := fmt.Sprintf("dns %s: %s", time.Since(p.dnsStart), strings.Join(ips, " "))
+			if err != nil {
+				step = fmt.Sprintf("dns %s: %v", time.Since(p.dnsStart), err)
+			}
+
+			p.steps = append(p.steps, step)
+		},
+		ConnectStart: func(_, address string) {
+			p.mu.Lock()
+			p.connects[address] = time.Now()
+			p.mu.Unlock()
+		},
+		ConnectDone: func(_, address string, err error) {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+
+			step := fmt.Sprintf("connect %s %s", address, time.Since(p.connects[address]))
+			if err != nil {
+				step += fmt.Sprintf(": %v", err)
+			}
+
+			p.steps = append(p.steps, step)
+		},
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// maxPooledSize caps the buffers a BinaryPool keeps. Bigger ones are left to
+// the garbage collector, so one huge frame doesn't pin its buffer for good.
+const maxPooledSize = 64 << 10
+
+var ErrNotBinary = errors.New("frame is not a Binary payload")
+
+// ReadBinaryInto reads a whole Binary frame, type included, into buf and
+// returns the part of buf holding the payload. Nothing is allocated, so a
+// reader that handles one frame at a time can reuse the same buffer for
+// every frame. The result is only valid until buf is reused.
+//
+// If the payload doesn't fit, it's skipped and io.ErrShortBuffer is
+// returned, so the stream stays in step and the next frame can still be
+// read. Frames of other types are skipped the same way, with ErrNotBinary.
+func ReadBinaryInto(r io.Reader, buf []byte) (Binary, error) {
+	if len(buf) < 5 {
+		return nil, io.ErrShortBuffer
+	}
+
+	// The header is read into buf itself; the payload overwrites it.
+	_, err := io.ReadFull(r, buf[:5])
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(buf[1:5])
+	if size > MaxPayloadSize {
+		return nil, ErrMaxPayloadSize
+	}
+
+	if buf[0] != BinaryType || int64(size) > int64(len(buf)) {
+		_, err = io.CopyN(io.Discard, r, int64(size))
+		if err != nil {
+			return nil, err
+		}
+
+		if buf[0] != BinaryType {
+			return nil, ErrNotBinary
+		}
+
+		return nil, io.ErrShortBuffer
+	}
+
+	_, err = io.ReadFull(r, buf[:size])
+	if err != nil {
+		return nil, err
+	}
+
+	return Binary(buf[:size]), nil
+}
+
+// BinaryPool decodes frames like decode does, except that Binary payloads
+// are read into recycled buffers instead of freshly allocated ones. Once the
+// pool is warm, decoding a Binary frame allocates nothing.
+//
+// The zero value is ready to use.
+type BinaryPool struct {
+	pool sync.Pool
+}
+
+// PooledBinary is a Binary payload whose buffer belongs to a BinaryPool. It
+// must be handed back with Release once the caller is done with it; neither
+// it nor any slice of its bytes may be used after that.
+type PooledBinary struct {
+	Binary
+
+	header [5]byte
+	pool   *BinaryPool
+}
+
+// Decode reads the next frame from r. Binary frames come back as a
+// *PooledBinary that the caller must Release; any other type is decoded as
+// usual. Heartbeats are skipped.
+func (p *BinaryPool) Decode(r io.Reader) (Payload, error) {
+	for {
+		payload, err := p.decode(r)
+		if err != nil || !isHeartbeat(payload) {
+			return payload, err
+		}
+	}
+}
+
+func (p *BinaryPool) decode(r io.Reader) (Payload, error) {
+	b := p.get()
+
+	_, err := io.ReadFull(r, b.header[:1])
+	if err != nil {
+		b.Release()
+		return nil, err
+	}
+
+	if typ := b.header[0]; typ != BinaryType {
+		b.Release()
+		return decodeType(typ, r)
+	}
+
+	_, err = b.ReadFrom(r)
+	if err != nil {
+		b.Release()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (p *BinaryPool) get() *PooledBinary {
+	b, ok := p.pool.Get().(*PooledBinary)
+	if !ok {
+		b = &PooledBinary{pool: p}
+	}
+
+	return b
+}
+
+// ReadFrom reads the size and payload of a Binary frame whose type has
+// already been consumed, reusing the current buffer if it's big enough.
+func (b *PooledBinary) ReadFrom(r io.Reader) (int64, error) {
+	var n int64 = 1
+
+	_, err := io.ReadFull(r, b.header[1:])
+	if err != nil {
+		return n, err
+	}
+
+	n += 4
+
+	size := binary.BigEndian.Uint32(b.header[1:])
+	if size > MaxPayloadSize {
+		return n, ErrMaxPayloadSize
+	}
+
+	if uint32(cap(b.Binary)) < size {
+		b.Binary = make(Binary, size)
+	}
+
+	b.Binary = b.Binary[:size]
+	o, err := io.ReadFull(r, b.Binary)
+
+	return n + int64(o), err
+}
+
+// Release returns b's buffer to its pool, unless it's grown past 64KB.
+// Calling it more than once, or using b afterwards, corrupts whichever frame
+// reuses the buffer next.
+func (b *PooledBinary) Release() {
+	if b.pool == nil || cap(b.Binary) > maxPooledSize {
+		return
+	}
+
+	b.Binary = b.Binary[:0]
+	b.pool.pool.Put(b)
+}
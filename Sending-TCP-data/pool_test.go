@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func binaryPayload(s string) *Binary {
+	b := Binary(s)
+	return &b
+}
+
+func stringPayload(s string) *String {
+	str := String(s)
+	return &str
+}
+
+func TestReadBinaryInto(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	for _, p := range []Payload{
+		&Binary{}, // empty payloads are valid
+		binaryPayload("Clear is better than clever."),
+		binaryPayload(string(bytes.Repeat([]byte{'x'}, 64))), // too big for the buffer below
+		binaryPayload("Don't panic."),
+	} {
+		_, err := p.WriteTo(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scratch := make([]byte, 32)
+
+	for i, expected := range []string{"", "Clear is better than clever."} {
+		actual, err := ReadBinaryInto(buf, scratch)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+
+		if string(actual) != expected {
+			t.Errorf("frame %d: expected %q; actual: %q", i, expected, actual)
+		}
+	}
+
+	_, err := ReadBinaryInto(buf, scratch)
+	if err != io.ErrShortBuffer {
+		t.Fatalf("expected io.ErrShortBuffer; actual: %v", err)
+	}
+
+	// The oversized frame was skipped, so the stream is still usable.
+	actual, err := ReadBinaryInto(buf, scratch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(actual) != "Don't panic." {
+		t.Errorf("expected %q; actual: %q", "Don't panic.", actual)
+	}
+
+	_, err = ReadBinaryInto(buf, scratch)
+	if err != io.EOF {
+		t.Errorf("expected io.EOF; actual: %v", err)
+	}
+}
+
+func TestReadBinaryIntoRejectsOtherTypes(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	_, err := String("Errors are values.").WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Binary("Don't panic.").WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scratch := make([]byte, 64)
+
+	_, err = ReadBinaryInto(buf, scratch)
+	if err != ErrNotBinary {
+		t.Errorf("expected ErrNotBinary; actual: %v", err)
+	}
+
+	// The string's body was skipped, so the next frame reads fine.
+	b, err := ReadBinaryInto(buf, scratch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "Don't panic." {
+		t.Errorf("expected %q; actual: %q", "Don't panic.", b)
+	}
+}
+
+func TestBinaryPool(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	for _, p := range []Payload{
+		binaryPayload("Clear is better than clever."),
+		&Ping{Seq: 1, Sent: time.Now()},
+		stringPayload("Errors are values."),
+		&Pong{Seq: 1, Sent: time.Now()},
+		binaryPayload("Don't panic."),
+	} {
+		_, err := p.WriteTo(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var pool BinaryPool
+
+	first, err := pool.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, ok := first.(*PooledBinary)
+	if !ok {
+		t.Fatalf("expected *PooledBinary; actual: %T", first)
+	}
+
+	if b.String() != "Clear is better than clever." {
+		t.Errorf("unexpected payload: %q", b)
+	}
+
+	b.Release()
+
+	second, err := pool.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, ok := second.(*String); !ok || *s != "Errors are values." {
+		t.Errorf("expected String payload; actual: %T %v", second, second)
+	}
+
+	third, err := pool.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if third.String() != "Don't panic." {
+		t.Errorf("unexpected payload: %q", third)
+	}
+
+	// A pooled payload re-encodes like any other Binary.
+	out := new(bytes.Buffer)
+	_, err = third.WriteTo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := decode(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.String() != "Don't panic." {
+		t.Errorf("unexpected round trip: %q", p)
+	}
+
+	third.(*PooledBinary).Release()
+
+	_, err = pool.Decode(buf)
+	if err != io.EOF {
+		t.Errorf("expected io.EOF; actual: %v", err)
+	}
+}
+
+func TestBinaryPoolMaxPayloadSize(t *testing.T) {
+	var pool BinaryPool
+
+	_, err := pool.Decode(bytes.NewReader([]byte{BinaryType, 0xff, 0xff, 0xff, 0xff}))
+	if err != ErrMaxPayloadSize {
+		t.Errorf("expected ErrMaxPayloadSize; actual: %v", err)
+	}
+}
+
+func TestBinaryPoolDropsOversizedBuffers(t *testing.T) {
+	var pool BinaryPool
+
+	buf := new(bytes.Buffer)
+
+	_, err := Binary(make([]byte, maxPooledSize+1)).WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := pool.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.(*PooledBinary).Release()
+
+	if b := pool.get(); cap(b.Binary) > maxPooledSize {
+		t.Errorf("expected the oversized buffer to be dropped; actual: pooled %d bytes", cap(b.Binary))
+	}
+}
+
+// benchmarkFrames returns a stream of identical Binary frames.
+func benchmarkFrames(b *testing.B, size, count int) []byte {
+	b.Helper()
+
+	buf := new(bytes.Buffer)
+	payload := Binary(bytes.Repeat([]byte{'x'}, size))
+
+	for i := 0; i < count; i++ {
+		_, err := payload.WriteTo(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// The three benchmarks below decode the same stream of 4KB frames, one frame
+// per iteration, so allocs/op is allocations per frame.
+
+func BenchmarkDecodeBinary(b *testing.B) {
+	stream := benchmarkFrames(b, 4<<10, 64)
+	r := bytes.NewReader(stream)
+
+	b.SetBytes(4 << 10)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if r.Len() == 0 {
+			r.Reset(stream)
+		}
+
+		_, err := decode(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadBinaryInto(b *testing.B) {
+	stream := benchmarkFrames(b, 4<<10, 64)
+	r := bytes.NewReader(stream)
+	buf := make([]byte, 8<<10)
+
+	b.SetBytes(4 << 10)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if r.Len() == 0 {
+			r.Reset(stream)
+		}
+
+		_, err := ReadBinaryInto(r, buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBinaryPoolDecode(b *testing.B) {
+	stream := benchmarkFrames(b, 4<<10, 64)
+	r := bytes.NewReader(stream)
+
+	var pool BinaryPool
+
+	b.SetBytes(4 << 10)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if r.Len() == 0 {
+			r.Reset(stream)
+		}
+
+		p, err := pool.Decode(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		p.(*PooledBinary).Release()
+	}
+}
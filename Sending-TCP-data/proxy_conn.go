@@ -12,19 +12,38 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"io"
 	"net"
+
+	ch03 "practice/network_programming/TCP"
+	tlsutil "practice/network_programming/TLS"
 )
 
 func proxyConn(source, destination string) error {
-	connSource, err := net.Dial("tcp", source)
+	return proxyConnTLS(source, destination, nil, nil)
+}
+
+// proxyConnTLS is proxyConn with either side, or both, over TLS. A nil config
+// leaves that side in plaintext. Since the data has to be decrypted and
+// re-encrypted in userspace, a TLS side misses out on the zero-copy transfer
+// described above.
+func proxyConnTLS(source, destination string, sourceCfg, destinationCfg *tls.Config) error {
+	return proxyConnContext(context.Background(), source, destination, sourceCfg, destinationCfg)
+}
+
+// proxyConnContext is proxyConnTLS with a context for the dials, e.g. to
+// carry a ch03.DialTrace showing which side is slow to connect.
+func proxyConnContext(ctx context.Context, source, destination string, sourceCfg, destinationCfg *tls.Config) error {
+	connSource, err := dialMaybeTLS(ctx, source, sourceCfg)
 	if err != nil {
 		return err
 	}
 
 	defer connSource.Close()
 
-	connDestination, err := net.Dial("tcp", destination)
+	connDestination, err := dialMaybeTLS(ctx, destination, destinationCfg)
 	if err != nil {
 		return err
 	}
@@ -39,3 +58,11 @@ func proxyConn(source, destination string) error {
 
 	return err
 }
+
+func dialMaybeTLS(ctx context.Context, address string, cfg *tls.Config) (net.Conn, error) {
+	if cfg == nil {
+		return ch03.DialContext(ctx, "tcp", address)
+	}
+
+	return tlsutil.DialContext(ctx, "tcp", address, cfg)
+}
@@ -0,0 +1,606 @@
+/*
+	A small request/response layer on top of the TLV payloads. Each request
+	carries an ID, a method name, an optional deadline and a body, which is
+	itself an encoded Payload. The server replies with either a Response or
+	an RPCError carrying the same ID, which is how the client matches replies
+	to the calls waiting on them. Since every reply is tagged, any number of
+	calls can be in flight over one connection and the server is free to
+	answer them out of order.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	ch03 "practice/network_programming/TCP"
+)
+
+var (
+	ErrClientClosed = errors.New("rpc: client closed")
+	ErrInvalidRPC   = errors.New("rpc: invalid frame")
+)
+
+// Request is sent by the client. Body may be nil.
+type Request struct {
+	ID       uint32
+	Method   string
+	Deadline time.Time // zero means no deadline
+	Body     Payload
+}
+
+func (m Request) Bytes() []byte { return payloadBytes(m.Body) }
+
+func (m Request) String() string { return fmt.Sprintf("%s#%d", m.Method, m.ID) }
+
+func (m Request) WriteTo(w io.Writer) (int64, error) {
+	if len(m.Method) > 0xffff {
+		return 0, errors.New("rpc: method name too long")
+	}
+
+	// ID + deadline + method length + method + body
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.BigEndian, m.ID)
+
+	var deadline int64
+	if !m.Deadline.IsZero() {
+		deadline = m.Deadline.UnixNano()
+	}
+
+	_ = binary.Write(buf, binary.BigEndian, deadline)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(m.Method)))
+	buf.WriteString(m.Method)
+
+	err := encodeBody(buf, m.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	return writeFrame(w, RequestType, buf.Bytes())
+}
+
+func (m *Request) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	if err != nil {
+		return n, err
+	}
+
+	budget := int64(MaxPayloadSize)
+
+	return n, m.parse(body, 1, &budget)
+}
+
+// parse decodes body, a Request nested depth levels deep in containers and
+// other requests and responses, sharing budget with them as a container's
+// members do.
+func (m *Request) parse(body []byte, depth int, budget *int64) error {
+	b := bytes.NewReader(body)
+
+	var (
+		deadline int64
+		size     uint16
+	)
+
+	err := binary.Read(b, binary.BigEndian, &m.ID)
+	if err == nil {
+		err = binary.Read(b, binary.BigEndian, &deadline)
+	}
+	if err == nil {
+		err = binary.Read(b, binary.BigEndian, &size)
+	}
+	if err != nil || b.Len() < int(size) {
+		return ErrInvalidRPC
+	}
+
+	method := make([]byte, size)
+	_, _ = b.Read(method)
+	m.Method = string(method)
+
+	m.Deadline = time.Time{}
+	if deadline != 0 {
+		m.Deadline = time.Unix(0, deadline)
+	}
+
+	m.Body, err = decodeBody(body[len(body)-b.Len():], depth, budget)
+
+	return err
+}
+
+// Response carries the result of a successful call. Body may be nil.
+type Response struct {
+	ID   uint32
+	Body Payload
+}
+
+func (m Response) Bytes() []byte { return payloadBytes(m.Body) }
+
+func (m Response) String() string { return fmt.Sprintf("response#%d", m.ID) }
+
+func (m Response) WriteTo(w io.Writer) (int64, error) {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.BigEndian, m.ID)
+
+	err := encodeBody(buf, m.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	return writeFrame(w, ResponseType, buf.Bytes())
+}
+
+func (m *Response) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	if err != nil {
+		return n, err
+	}
+
+	budget := int64(MaxPayloadSize)
+
+	return n, m.parse(body, 1, &budget)
+}
+
+// parse decodes body, a Response nested depth levels deep, as Request.parse.
+func (m *Response) parse(body []byte, depth int, budget *int64) error {
+	if len(body) < 4 {
+		return ErrInvalidRPC
+	}
+
+	var err error
+
+	m.ID = binary.BigEndian.Uint32(body)
+	m.Body, err = decodeBody(body[4:], depth, budget)
+
+	return err
+}
+
+// RPCError is sent in place of a Response when a call fails. It's returned
+// from Call as is, so it implements error as well as Payload.
+type RPCError struct {
+	ID      uint32
+	Message string
+}
+
+func (m RPCError) Bytes() []byte { return []byte(m.Message) }
+
+func (m RPCError) String() string { return m.Message }
+
+func (m RPCError) Error() string { return "rpc: " + m.Message }
+
+func (m RPCError) WriteTo(w io.Writer) (int64, error) {
+	body := make([]byte, 4+len(m.Message))
+	binary.BigEndian.PutUint32(body, m.ID)
+	copy(body[4:], m.Message)
+
+	return writeFrame(w, ErrorType, body)
+}
+
+func (m *RPCError) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	if err != nil {
+		return n, err
+	}
+
+	if len(body) < 4 {
+		return n, ErrInvalidRPC
+	}
+
+	m.ID = binary.BigEndian.Uint32(body)
+	m.Message = string(body[4:])
+
+	return n, nil
+}
+
+// encodeBody appends the frame for p to buf. A nil body is encoded as nothing.
+func encodeBody(buf *bytes.Buffer, p Payload) error {
+	if p == nil {
+		return nil
+	}
+
+	_, err := p.WriteTo(buf)
+
+	return err
+}
+
+// decodeBody is the inverse of encodeBody. The body must be exactly one frame.
+// It's decoded as a member of a container nested depth levels deep, so
+// requests and responses can't be used to get around MaxContainerDepth or
+// the inflate budget.
+func decodeBody(b []byte, depth int, budget *int64) (Payload, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+
+	p, rest, err := decodeMember(b, depth, budget)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) != 0 {
+		return nil, ErrInvalidRPC
+	}
+
+	// Unlike a container, a body has to be something we understand.
+	if _, ok := p.(*Unknown); ok {
+		_, err = newPayload(b[0])
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func payloadBytes(p Payload) []byte {
+	if p == nil {
+		return nil
+	}
+
+	return p.Bytes()
+}
+
+// HandlerFunc handles a single call. The context is cancelled once the
+// request's deadline passes or the connection goes away.
+type HandlerFunc func(ctx context.Context, p Payload) (Payload, error)
+
+// RPCServer dispatches requests to the handlers registered for their method.
+type RPCServer struct {
+	// Authenticator, if set, must accept a connection before any requests
+	// are read from it. Handlers get the peer's identity through
+	// IdentityFromContext.
+	Authenticator *Authenticator
+
+	// AuthTimeout is how long a peer has to pass the Authenticator before
+	// its connection is dropped. Zero means DefaultAuthTimeout.
+	AuthTimeout time.Duration
+
+	mu       sync.RWMutex
+	handlers map[string]HandlerFunc
+}
+
+func NewRPCServer() *RPCServer {
+	return &RPCServer{handlers: make(map[string]HandlerFunc)}
+}
+
+// Handle registers h for method, replacing any existing handler.
+func (s *RPCServer) Handle(method string, h HandlerFunc) {
+	s.mu.Lock()
+	s.handlers[method] = h
+	s.mu.Unlock()
+}
+
+func (s *RPCServer) handler(method string) (HandlerFunc, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	h, ok := s.handlers[method]
+
+	return h, ok
+}
+
+// Serve accepts connections on l and serves each of them in its own goroutine.
+func (s *RPCServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func(c net.Conn) {
+			defer func() { _ = c.Close() }()
+			_ = s.ServeConn(context.Background(), c)
+		}(conn)
+	}
+}
+
+// ServeConn reads requests from conn until it's closed or a malformed frame
+// arrives. Each request runs in its own goroutine; replies are written as
+// soon as they're ready, so a slow handler doesn't hold up the others. If
+// the server has an Authenticator, the peer has to pass it first.
+func (s *RPCServer) ServeConn(ctx context.Context, conn net.Conn) error {
+	if s.Authenticator != nil {
+		timeout := s.AuthTimeout
+		if timeout <= 0 {
+			timeout = DefaultAuthTimeout
+		}
+
+		err := conn.SetDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return err
+		}
+
+		identity, err := s.Authenticator.Authenticate(conn)
+		if err != nil {
+			return err
+		}
+
+		err = conn.SetDeadline(time.Time{})
+		if err != nil {
+			return err
+		}
+
+		ctx = WithIdentity(ctx, identity)
+	}
+
+	var (
+		wg  sync.WaitGroup
+		wmu sync.Mutex // serializes writes so frames don't interleave
+	)
+
+	// Handlers still running when the connection goes away are cancelled
+	// before we wait on them.
+	defer wg.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	reply := func(p Payload) {
+		wmu.Lock()
+		_, _ = p.WriteTo(conn)
+		wmu.Unlock()
+	}
+
+	// Pings are answered in the background so the read loop never blocks
+	// on a write.
+	dec := NewDecoder(conn, func(p Payload) error {
+		go reply(p)
+		return nil
+	})
+
+	for {
+		p, err := dec.Decode()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		req, ok := p.(*Request)
+		if !ok {
+			return fmt.Errorf("%w: unexpected %T", ErrInvalidRPC, p)
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			h, ok := s.handler(req.Method)
+			if !ok {
+				reply(&RPCError{ID: req.ID, Message: fmt.Sprintf("unknown method %q", req.Method)})
+				return
+			}
+
+			hCtx, hCancel := ctx, context.CancelFunc(func() {})
+			if !req.Deadline.IsZero() {
+				hCtx, hCancel = context.WithDeadline(ctx, req.Deadline)
+			}
+
+			defer hCancel()
+
+			if hCtx.Err() != nil {
+				reply(&RPCError{ID: req.ID, Message: hCtx.Err().Error()})
+				return
+			}
+
+			resp, err := h(hCtx, req.Body)
+			if err != nil {
+				reply(&RPCError{ID: req.ID, Message: err.Error()})
+				return
+			}
+
+			reply(&Response{ID: req.ID, Body: resp})
+		}()
+	}
+}
+
+type rpcResult struct {
+	payload Payload
+	err     error
+}
+
+// RPCClient issues calls over a single connection. It's safe for concurrent
+// use; replies are routed back to their callers by request ID.
+type RPCClient struct {
+	conn net.Conn
+	cc   *ch03.ContextConn // bounds request writes by the call's context
+	dec  *Decoder
+
+	wmu sync.Mutex // serializes writes
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan rpcResult
+	err     error // why the read loop stopped
+
+	done chan struct{}
+}
+
+// NewRPCClient starts reading replies from conn. The client owns conn from
+// here on and closes it in Close.
+func NewRPCClient(conn net.Conn) *RPCClient {
+	c := &RPCClient{
+		conn:    conn,
+		cc:      ch03.NewContextConn(conn),
+		pending: make(map[uint32]chan rpcResult),
+		done:    make(chan struct{}),
+	}
+
+	c.dec = NewDecoder(conn, c.answer)
+
+	go c.readLoop()
+
+	return c
+}
+
+func (c *RPCClient) readLoop() {
+	var err error
+
+	for {
+		var p Payload
+		p, err = c.dec.Decode()
+		if err != nil {
+			break
+		}
+
+		var (
+			id     uint32
+			result rpcResult
+		)
+
+		switch m := p.(type) {
+		case *Response:
+			id, result.payload = m.ID, m.Body
+		case *RPCError:
+			id, result.err = m.ID, m
+		default:
+			err = fmt.Errorf("%w: unexpected %T", ErrInvalidRPC, p)
+		}
+
+		if err != nil {
+			break
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		// The caller may have given up already, in which case the reply is
+		// simply dropped.
+		if ok {
+			ch <- result
+		}
+	}
+
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+
+	close(c.done)
+}
+
+// answer writes the pong to a ping in the background, so the read loop never
+// blocks on a write.
+func (c *RPCClient) answer(p Payload) error {
+	go func() {
+		c.wmu.Lock()
+		_, _ = p.WriteTo(c.conn)
+		c.wmu.Unlock()
+	}()
+
+	return nil
+}
+
+// Call sends p to method and waits for the reply. The context's deadline is
+// forwarded to the server so the handler can stop early too. It also bounds
+// sending the request: if ctx is done before the request is fully written,
+// the connection is out of step and the client is closed.
+func (c *RPCClient) Call(ctx context.Context, method string, p Payload) (Payload, error) {
+	ch := make(chan rpcResult, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+
+		return nil, err
+	}
+
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	forget := func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}
+
+	req := &Request{ID: id, Method: method, Body: p}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Deadline = deadline
+	}
+
+	c.wmu.Lock()
+	n, err := req.WriteTo(contextWriter{ctx: ctx, cc: c.cc})
+	c.wmu.Unlock()
+
+	if err != nil {
+		forget()
+
+		if n > 0 {
+			c.fail(err)
+		}
+
+		return nil, err
+	}
+
+	select {
+	case res := <-ch:
+		return res.payload, res.err
+	case <-ctx.Done():
+		forget()
+		return nil, ctx.Err()
+	case <-c.done:
+		forget()
+
+		// The reply may have arrived just before the read loop stopped.
+		select {
+		case res := <-ch:
+			return res.payload, res.err
+		default:
+		}
+
+		c.mu.Lock()
+		err = c.err
+		c.mu.Unlock()
+
+		return nil, err
+	}
+}
+
+// fail closes the connection after a write was cut off part way. Calls
+// still waiting get err.
+func (c *RPCClient) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+
+	_ = c.conn.Close()
+}
+
+// contextWriter writes to cc, giving up once ctx is done.
+type contextWriter struct {
+	ctx context.Context
+	cc  *ch03.ContextConn
+}
+
+func (w contextWriter) Write(b []byte) (int, error) {
+	return w.cc.WriteContext(w.ctx, b)
+}
+
+// Close closes the connection. Calls still waiting get ErrClientClosed.
+func (c *RPCClient) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = ErrClientClosed
+	}
+	c.mu.Unlock()
+
+	err := c.conn.Close()
+	<-c.done
+
+	return err
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRPC(t *testing.T) {
+	server := NewRPCServer()
+	server.Handle("upper", func(_ context.Context, p Payload) (Payload, error) {
+		s := String(strings.ToUpper(p.String()))
+		return &s, nil
+	})
+	server.Handle("fail", func(_ context.Context, _ Payload) (Payload, error) {
+		return nil, errors.New("Don't panic.")
+	})
+	server.Handle("wait", func(ctx context.Context, _ Payload) (Payload, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go func() { _ = server.Serve(listener) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewRPCClient(conn)
+	defer client.Close()
+
+	ctx := context.Background()
+
+	// A call that never returns on its own mustn't hold up the others.
+	waitCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+
+	waitErr := make(chan error)
+	go func() {
+		_, err := client.Call(waitCtx, "wait", nil)
+		waitErr <- err
+	}()
+
+	var wg sync.WaitGroup
+
+	for _, msg := range []string{"Clear is better than clever.", "Errors are values.", "Don't panic."} {
+		wg.Add(1)
+
+		go func(msg string) {
+			defer wg.Done()
+
+			s := String(msg)
+			reply, err := client.Call(ctx, "upper", &s)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if expected := strings.ToUpper(msg); reply.String() != expected {
+				t.Errorf("expected reply %q; actual reply %q", expected, reply)
+			}
+		}(msg)
+	}
+
+	wg.Wait()
+
+	select {
+	case err := <-waitErr:
+		t.Fatalf("wait call returned early: %v", err)
+	default:
+	}
+
+	_, err = client.Call(ctx, "fail", nil)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Message != "Don't panic." {
+		t.Errorf("expected remote error; actual: %v", err)
+	}
+
+	_, err = client.Call(ctx, "missing", nil)
+	if !errors.As(err, &rpcErr) {
+		t.Errorf("expected unknown method error; actual: %v", err)
+	}
+
+	if err := <-waitErr; err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded; actual: %v", err)
+	}
+}
+
+func TestRPCClientClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := NewRPCClient(client)
+
+	// Read and discard the request so Call gets as far as waiting for the
+	// reply, which never comes.
+	go func() { _, _ = decode(server) }()
+
+	errs := make(chan error)
+	go func() {
+		_, err := c.Call(context.Background(), "wait", nil)
+		errs <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	_ = c.Close()
+
+	if err := <-errs; err != ErrClientClosed {
+		t.Fatalf("expected ErrClientClosed; actual: %v", err)
+	}
+}
+
+func TestRPCCallWriteHonorsContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// The server never reads, so the request can't be written.
+	c := NewRPCClient(client)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err := c.Call(ctx, "wait", nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded; actual: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Call to give up after 100ms; took %s", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err = c.Call(ctx, "wait", nil)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled; actual: %v", err)
+	}
+}
+
+func TestRPCCallClosesAfterPartialWrite(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The server accepts but never reads, so a big request fills the socket
+	// buffers and is cut off part way.
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(2 * time.Second)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewRPCClient(conn)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	big := Binary(make([]byte, 8<<20))
+
+	_, err = c.Call(ctx, "upload", &big)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded; actual: %v", err)
+	}
+
+	_, err = c.Call(context.Background(), "upload", nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the client to be closed with the write's error; actual: %v", err)
+	}
+}
+
+func TestRPCHeartbeats(t *testing.T) {
+	server := NewRPCServer()
+	server.Handle("echo", func(_ context.Context, p Payload) (Payload, error) {
+		return p, nil
+	})
+
+	// The server answers a ping and keeps serving.
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	go func() { _ = server.ServeConn(context.Background(), conn) }()
+
+	_, err := (&Ping{Seq: 1, Sent: time.Now()}).WriteTo(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := decode(peer)
+	if pong, ok := p.(*Pong); err != nil || !ok || pong.Seq != 1 {
+		t.Fatalf("expected pong 1; actual: %v, %v", p, err)
+	}
+
+	// The client answers a ping that arrives ahead of its reply.
+	conn, peer = net.Pipe()
+	defer peer.Close()
+
+	client := NewRPCClient(conn)
+	defer client.Close()
+
+	go func() {
+		p, err := decode(peer)
+		req, ok := p.(*Request)
+		if err != nil || !ok {
+			t.Errorf("expected request; actual: %v, %v", p, err)
+			return
+		}
+
+		_, _ = (&Ping{Seq: 2, Sent: time.Now()}).WriteTo(peer)
+
+		p, err = decode(peer)
+		if pong, ok := p.(*Pong); err != nil || !ok || pong.Seq != 2 {
+			t.Errorf("expected pong 2; actual: %v, %v", p, err)
+		}
+
+		_, _ = (&Response{ID: req.ID, Body: req.Body}).WriteTo(peer)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	s := String("Errors are values.")
+	reply, err := client.Call(ctx, "echo", &s)
+	if err != nil || reply.String() != "Errors are values." {
+		t.Errorf("unexpected reply: %v, %v", reply, err)
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"io"
 	"net"
 	"reflect"
 	"testing"
+	"testing/iotest"
 )
 
 const payload = "The bigger the interface, the weaker the abstraction"
@@ -59,3 +63,116 @@ func TestScanner(t *testing.T) {
 
 	t.Logf("scanned words: %#v", words)
 }
+
+func TestFrameScanner(t *testing.T) {
+	payloads := []Payload{
+		stringPayload("Clear is better than clever."),
+		&Binary{},
+		binaryPayload(string(bytes.Repeat([]byte{'x'}, 100<<10))), // bigger than bufio.MaxScanTokenSize
+		&Record{{ID: 1, Value: stringPayload("gopher")}},
+	}
+
+	buf := new(bytes.Buffer)
+
+	for _, p := range payloads {
+		_, err := p.WriteTo(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Handing the scanner a byte at a time makes sure frames split across
+	// reads are put back together.
+	scanner := NewFrameScanner(iotest.OneByteReader(buf), MaxPayloadSize)
+
+	var actual []Payload
+
+	for scanner.Scan() {
+		p, err := ParseFrame(scanner.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual = append(actual, p)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(actual) != len(payloads) {
+		t.Fatalf("expected %d frames; actual: %d", len(payloads), len(actual))
+	}
+
+	for i := range payloads {
+		if !bytes.Equal(actual[i].Bytes(), payloads[i].Bytes()) {
+			t.Errorf("frame %d: expected %q; actual: %q", i, payloads[i], actual[i])
+		}
+	}
+}
+
+func TestFrameScannerErrors(t *testing.T) {
+	frame := new(bytes.Buffer)
+
+	_, err := String("Errors are values.").WriteTo(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		input    []byte
+		max      uint32
+		expected error
+	}{
+		"truncated header": {frame.Bytes()[:3], MaxPayloadSize, io.ErrUnexpectedEOF},
+		"truncated body":   {frame.Bytes()[:frame.Len()-1], MaxPayloadSize, io.ErrUnexpectedEOF},
+		"too large":        {frame.Bytes(), 8, ErrMaxPayloadSize},
+	} {
+		scanner := NewFrameScanner(bytes.NewReader(tc.input), tc.max)
+
+		if scanner.Scan() {
+			t.Errorf("%s: expected no token; actual: %q", name, scanner.Bytes())
+		}
+
+		if !errors.Is(scanner.Err(), tc.expected) {
+			t.Errorf("%s: expected %v; actual: %v", name, tc.expected, scanner.Err())
+		}
+	}
+}
+
+func TestScanFramesDefaultBuffer(t *testing.T) {
+	p := Binary(bytes.Repeat([]byte{'x'}, bufio.MaxScanTokenSize))
+	buf := new(bytes.Buffer)
+
+	_, err := p.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A plain Scanner works with ScanFrames, but only up to its buffer size.
+	scanner := bufio.NewScanner(buf)
+	scanner.Split(ScanFrames)
+
+	if scanner.Scan() {
+		t.Fatal("expected frame to exceed the default buffer")
+	}
+
+	if scanner.Err() != bufio.ErrTooLong {
+		t.Errorf("expected bufio.ErrTooLong; actual: %v", scanner.Err())
+	}
+}
+
+func TestParseFrameTrailingData(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	_, err := String("Errors are values.").WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseFrame(append(buf.Bytes(), 0))
+	if !errors.Is(err, ErrFrameTrailingData) {
+		t.Errorf("expected ErrFrameTrailingData; actual: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrFrameTrailingData = errors.New("frame has trailing data")
+
+// ScanFrames is a bufio.SplitFunc that returns each whole frame, header
+// included, as a token. Frames bigger than MaxPayloadSize are an error.
+//
+// A Scanner's default buffer only holds 64KB, so scanning with ScanFrames
+// directly fails with bufio.ErrTooLong on larger frames; NewFrameScanner
+// sizes the buffer to match the frame limit.
+var ScanFrames = FrameSplitFunc(MaxPayloadSize)
+
+// FrameSplitFunc returns a bufio.SplitFunc like ScanFrames that allows
+// payloads of up to max bytes.
+func FrameSplitFunc(max uint32) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+
+		if len(data) < 5 {
+			if atEOF {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+
+			return 0, nil, nil // need the rest of the header
+		}
+
+		size := binary.BigEndian.Uint32(data[1:5])
+		if size > max {
+			return 0, nil, ErrMaxPayloadSize
+		}
+
+		end := 5 + int(size)
+		if len(data) < end {
+			if atEOF {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+
+			return 0, nil, nil
+		}
+
+		return end, data[:end], nil
+	}
+}
+
+// NewFrameScanner returns a Scanner over the frames in r, with a buffer big
+// enough for payloads of up to max bytes.
+func NewFrameScanner(r io.Reader, max uint32) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), 5+int(max))
+	scanner.Split(FrameSplitFunc(max))
+
+	return scanner
+}
+
+// ParseFrame decodes a single raw frame such as a token from ScanFrames. The
+// frame's decoder must use up the whole token.
+//
+// Payloads don't keep a reference to token, so it's fine to pass
+// Scanner.Bytes directly.
+func ParseFrame(token []byte) (Payload, error) {
+	r := bytes.NewReader(token)
+
+	p, err := decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTrailingData, r.Len())
+	}
+
+	return p, nil
+}
@@ -0,0 +1,329 @@
+/*
+	Streaming objects that are too big for one frame. An object is sent as
+	a run of chunk frames followed by a single trailer frame:
+
+		chunk    stream ID + up to ChunkSize bytes of the object
+		...
+		trailer  stream ID + total size + SHA-256 of the object
+		         + abort reason (empty unless the transfer was aborted)
+
+	Neither side ever holds more than one chunk in memory, so the size of
+	an object isn't bounded by MaxPayloadSize. The sender can give up part
+	way through by sending a trailer with a reason, and the receiver then
+	fails instead of mistaking the truncated object for a complete one.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// DefaultChunkSize is the chunk size StreamWriter uses unless told otherwise.
+const DefaultChunkSize = 64 << 10
+
+var (
+	ErrStreamAborted  = errors.New("stream: aborted by sender")
+	ErrStreamCorrupt  = errors.New("stream: object doesn't match trailer")
+	ErrStreamProtocol = errors.New("stream: protocol error")
+	ErrStreamClosed   = errors.New("stream: writer closed")
+)
+
+// Chunk is one piece of a streamed object.
+type Chunk struct {
+	Stream uint32
+	Data   []byte
+}
+
+func (m Chunk) Bytes() []byte { return m.Data }
+
+func (m Chunk) String() string { return fmt.Sprintf("chunk of stream %d, %d bytes", m.Stream, len(m.Data)) }
+
+func (m Chunk) WriteTo(w io.Writer) (int64, error) {
+	body := make([]byte, 4, 4+len(m.Data))
+	binary.BigEndian.PutUint32(body, m.Stream)
+	body = append(body, m.Data...)
+
+	return writeFrame(w, ChunkType, body)
+}
+
+func (m *Chunk) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	if err != nil {
+		return n, err
+	}
+
+	if len(body) < 4 {
+		return n, fmt.Errorf("%w: short chunk", ErrStreamProtocol)
+	}
+
+	m.Stream = binary.BigEndian.Uint32(body)
+	m.Data = body[4:]
+
+	return n, nil
+}
+
+// Trailer ends a streamed object. Abort is empty for a complete object;
+// otherwise Size and Sum cover only what was sent before the abort.
+type Trailer struct {
+	Stream uint32
+	Size   uint64
+	Sum    [sha256.Size]byte
+	Abort  string
+}
+
+func (m Trailer) Bytes() []byte { return m.Sum[:] }
+
+func (m Trailer) String() string {
+	if m.Abort != "" {
+		return fmt.Sprintf("trailer of stream %d, aborted: %s", m.Stream, m.Abort)
+	}
+
+	return fmt.Sprintf("trailer of stream %d, %d bytes", m.Stream, m.Size)
+}
+
+func (m Trailer) WriteTo(w io.Writer) (int64, error) {
+	// stream ID + size + sum + abort reason
+	body := make([]byte, 12, 12+sha256.Size+len(m.Abort))
+	binary.BigEndian.PutUint32(body, m.Stream)
+	binary.BigEndian.PutUint64(body[4:], m.Size)
+	body = append(body, m.Sum[:]...)
+	body = append(body, m.Abort...)
+
+	return writeFrame(w, TrailerType, body)
+}
+
+func (m *Trailer) ReadFrom(r io.Reader) (int64, error) {
+	n, body, err := readFrameBody(r)
+	if err != nil {
+		return n, err
+	}
+
+	if len(body) < 12+sha256.Size {
+		return n, fmt.Errorf("%w: short trailer", ErrStreamProtocol)
+	}
+
+	m.Stream = binary.BigEndian.Uint32(body)
+	m.Size = binary.BigEndian.Uint64(body[4:])
+	copy(m.Sum[:], body[12:])
+	m.Abort = string(body[12+sha256.Size:])
+
+	return n, nil
+}
+
+// StreamWriter sends an object written to it as a stream of chunks. Close
+// must be called to send the trailer; until then the receiver can't tell
+// that the object is complete. StreamWriter isn't safe for concurrent use.
+type StreamWriter struct {
+	w      io.Writer
+	id     uint32
+	buf    []byte
+	sum    hash.Hash
+	size   uint64
+	closed bool
+}
+
+// NewStreamWriter sends stream id over w in chunks of chunkSize bytes, or
+// DefaultChunkSize if chunkSize isn't positive.
+func NewStreamWriter(w io.Writer, id uint32, chunkSize int) *StreamWriter {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	if max := int(MaxPayloadSize) - 4; chunkSize > max {
+		chunkSize = max
+	}
+
+	return &StreamWriter{
+		w:   w,
+		id:  id,
+		buf: make([]byte, 0, chunkSize),
+		sum: sha256.New(),
+	}
+}
+
+// Write buffers p, sending a chunk whenever a full one has been collected.
+func (s *StreamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, ErrStreamClosed
+	}
+
+	var n int
+
+	for len(p) > 0 {
+		o := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+o]
+		p = p[o:]
+
+		if len(s.buf) == cap(s.buf) {
+			err := s.flush()
+			if err != nil {
+				return n, err
+			}
+		}
+
+		n += o
+	}
+
+	return n, nil
+}
+
+// Close sends any buffered data followed by the trailer.
+func (s *StreamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+
+	err := s.flush()
+	if err != nil {
+		return err
+	}
+
+	return s.finish("")
+}
+
+// Abort tells the receiver the object won't be completed. Buffered data is
+// discarded.
+func (s *StreamWriter) Abort(reason error) error {
+	if s.closed {
+		return ErrStreamClosed
+	}
+
+	msg := "aborted"
+	if reason != nil {
+		msg = reason.Error()
+	}
+
+	return s.finish(msg)
+}
+
+func (s *StreamWriter) flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+
+	_, err := Chunk{Stream: s.id, Data: s.buf}.WriteTo(s.w)
+	if err != nil {
+		return err
+	}
+
+	s.sum.Write(s.buf)
+	s.size += uint64(len(s.buf))
+	s.buf = s.buf[:0]
+
+	return nil
+}
+
+func (s *StreamWriter) finish(abort string) error {
+	s.closed = true
+
+	t := Trailer{Stream: s.id, Size: s.size, Abort: abort}
+	copy(t.Sum[:], s.sum.Sum(nil))
+
+	_, err := t.WriteTo(s.w)
+
+	return err
+}
+
+// StreamReader reassembles a streamed object. Read returns io.EOF once the
+// trailer has been received and the object checked against it. If the
+// sender aborted, Read returns an error wrapping ErrStreamAborted instead.
+type StreamReader struct {
+	r       io.Reader
+	id      uint32
+	started bool
+	chunk   []byte
+	sum     hash.Hash
+	size    uint64
+	err     error
+}
+
+// NewStreamReader reads the next streamed object from r. The stream ID is
+// taken from the first frame; frames of other streams or types are a
+// protocol error.
+func NewStreamReader(r io.Reader) *StreamReader {
+	return &StreamReader{r: r, sum: sha256.New()}
+}
+
+// ID returns the stream ID, which is only known after the first Read.
+func (s *StreamReader) ID() uint32 { return s.id }
+
+func (s *StreamReader) Read(p []byte) (int, error) {
+	for len(s.chunk) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+
+		s.err = s.next()
+	}
+
+	n := copy(p, s.chunk)
+	s.chunk = s.chunk[n:]
+
+	return n, nil
+}
+
+// next reads one frame, leaving the chunk's data in s.chunk or returning
+// the error that ends the stream.
+func (s *StreamReader) next() error {
+	p, err := decode(s.r)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return err
+	}
+
+	switch f := p.(type) {
+	case *Ping, *Pong:
+		// Leaving s.chunk empty has Read come back for the next frame.
+		return nil
+	case *Chunk:
+		err = s.checkID(f.Stream)
+		if err != nil {
+			return err
+		}
+
+		s.sum.Write(f.Data)
+		s.size += uint64(len(f.Data))
+		s.chunk = f.Data
+
+		return nil
+	case *Trailer:
+		err = s.checkID(f.Stream)
+		if err != nil {
+			return err
+		}
+
+		if f.Abort != "" {
+			return fmt.Errorf("%w: %s", ErrStreamAborted, f.Abort)
+		}
+
+		if f.Size != s.size || !bytes.Equal(f.Sum[:], s.sum.Sum(nil)) {
+			return ErrStreamCorrupt
+		}
+
+		return io.EOF
+	default:
+		return fmt.Errorf("%w: unexpected %T", ErrStreamProtocol, p)
+	}
+}
+
+func (s *StreamReader) checkID(id uint32) error {
+	if !s.started {
+		s.id, s.started = id, true
+		return nil
+	}
+
+	if id != s.id {
+		return fmt.Errorf("%w: frame for stream %d inside stream %d", ErrStreamProtocol, id, s.id)
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamLargeObject(t *testing.T) {
+	// Bigger than a single frame may be.
+	object := make([]byte, int(MaxPayloadSize)+3<<20)
+	rand.New(rand.NewSource(1)).Read(object)
+
+	client, server := net.Pipe()
+	defer func() { _ = client.Close() }()
+
+	errs := make(chan error, 1)
+
+	go func() {
+		defer func() { _ = server.Close() }()
+
+		w := NewStreamWriter(server, 7, 0)
+
+		_, err := io.Copy(w, bytes.NewReader(object))
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		errs <- w.Close()
+	}()
+
+	r := NewStreamReader(client)
+	h := sha256.New()
+
+	n, err := io.Copy(h, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(len(object)) {
+		t.Errorf("expected %d bytes; actual: %d", len(object), n)
+	}
+
+	if expected := sha256.Sum256(object); !bytes.Equal(h.Sum(nil), expected[:]) {
+		t.Error("received object doesn't match what was sent")
+	}
+
+	if r.ID() != 7 {
+		t.Errorf("expected stream 7; actual: %d", r.ID())
+	}
+}
+
+func TestStreamEmptyObject(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	err := NewStreamWriter(buf, 1, 0).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(NewStreamReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b) != 0 {
+		t.Errorf("expected an empty object; actual: %d bytes", len(b))
+	}
+}
+
+func TestStreamAbort(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewStreamWriter(buf, 1, 16)
+
+	_, err := w.Write(bytes.Repeat([]byte{'x'}, 40))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Abort(errors.New("disk full"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write([]byte("more"))
+	if err != ErrStreamClosed {
+		t.Errorf("expected ErrStreamClosed; actual: %v", err)
+	}
+
+	b, err := io.ReadAll(NewStreamReader(buf))
+	if !errors.Is(err, ErrStreamAborted) {
+		t.Fatalf("expected ErrStreamAborted; actual: %v", err)
+	}
+
+	// The full chunks sent before the abort are still delivered.
+	if len(b) != 32 {
+		t.Errorf("expected 32 bytes before the abort; actual: %d", len(b))
+	}
+}
+
+func TestStreamHeartbeats(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewStreamWriter(buf, 1, 16)
+
+	_, err := w.Write(bytes.Repeat([]byte{'x'}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What a FramedPinger on the same connection would send mid-transfer.
+	_, err = (&Ping{Seq: 1, Sent: time.Now()}).WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(bytes.Repeat([]byte{'y'}, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = (&Pong{Seq: 1, Sent: time.Now()}).WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(NewStreamReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := strings.Repeat("x", 32) + strings.Repeat("y", 8); string(b) != expected {
+		t.Errorf("expected %q; actual: %q", expected, b)
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewStreamWriter(buf, 1, 16)
+
+	_, err := w.Write(bytes.Repeat([]byte{'x'}, 40))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No Close, so no trailer: the connection just ends.
+	_, err = io.ReadAll(NewStreamReader(buf))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF; actual: %v", err)
+	}
+}
+
+func TestStreamCorrupt(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	for _, p := range []Payload{
+		&Chunk{Stream: 1, Data: []byte("Clear is better than clever.")},
+		&Trailer{Stream: 1, Size: 28},
+	} {
+		_, err := p.WriteTo(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := io.ReadAll(NewStreamReader(buf))
+	if err != ErrStreamCorrupt {
+		t.Errorf("expected ErrStreamCorrupt; actual: %v", err)
+	}
+}
+
+func TestStreamInterleaved(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	for _, p := range []Payload{
+		&Chunk{Stream: 1, Data: []byte("Clear is better")},
+		&Chunk{Stream: 2, Data: []byte(" than clever.")},
+	} {
+		_, err := p.WriteTo(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := io.ReadAll(NewStreamReader(buf))
+	if !errors.Is(err, ErrStreamProtocol) {
+		t.Errorf("expected ErrStreamProtocol; actual: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The tool works on raw frames rather than the Payload types so it can show
+// anything that's framed correctly, including types it has never heard of.
+// The names have to be kept in step with the type constants in types.go.
+var typeNames = map[uint8]string{
+	1:  "binary",
+	2:  "string",
+	3:  "compressed",
+	4:  "request",
+	5:  "response",
+	6:  "error",
+	7:  "mux",
+	8:  "record",
+	9:  "list",
+	10: "hello",
+	11: "auth",
+	12: "chunk",
+	13: "trailer",
+	14: "ping",
+	15: "pong",
+}
+
+const defaultMaxFrame = 10 << 20 // matches MaxPayloadSize
+
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+// Frame is a single TLV frame and where it started in the stream.
+type Frame struct {
+	Offset int64
+	Type   uint8
+	Body   []byte
+}
+
+func (f Frame) TypeName() string {
+	if name, ok := typeNames[f.Type]; ok {
+		return name
+	}
+
+	return "type(" + strconv.Itoa(int(f.Type)) + ")"
+}
+
+// FrameReader reads frames one after the other, keeping track of offsets.
+type FrameReader struct {
+	r      io.Reader
+	offset int64
+	max    uint32
+}
+
+func NewFrameReader(r io.Reader, max uint32) *FrameReader {
+	if max == 0 {
+		max = defaultMaxFrame
+	}
+
+	return &FrameReader{r: r, max: max}
+}
+
+// Next returns the next frame. It returns io.EOF at a clean frame boundary and
+// io.ErrUnexpectedEOF if the stream ends part way through a frame.
+func (fr *FrameReader) Next() (Frame, error) {
+	f := Frame{Offset: fr.offset}
+
+	header := make([]byte, 5)
+	n, err := io.ReadFull(fr.r, header)
+	fr.offset += int64(n)
+	if err != nil {
+		return f, err
+	}
+
+	f.Type = header[0]
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > fr.max {
+		return f, fmt.Errorf("%w (%d > %d)", ErrFrameTooLarge, size, fr.max)
+	}
+
+	f.Body = make([]byte, size)
+	n, err = io.ReadFull(fr.r, f.Body)
+	fr.offset += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return f, err
+}
+
+// WriteFrame writes f in the wire format.
+func WriteFrame(w io.Writer, f Frame) error {
+	header := make([]byte, 5)
+	header[0] = f.Type
+	binary.BigEndian.PutUint32(header[1:], uint32(len(f.Body)))
+
+	_, err := w.Write(append(header, f.Body...))
+
+	return err
+}
+
+// Preview returns up to max bytes of the body, as quoted text when the body
+// is printable and as hex otherwise.
+func (f Frame) Preview(max int, forceHex bool) string {
+	body, more := f.Body, ""
+	if max > 0 && len(body) > max {
+		body, more = body[:max], "..."
+	}
+
+	if !forceHex && printable(f.Body) {
+		return strconv.Quote(string(body)) + more
+	}
+
+	return hex.EncodeToString(body) + more
+}
+
+func printable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+
+	for _, r := range string(b) {
+		if !strconv.IsPrint(r) && !strings.ContainsRune("\t\r\n", r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// jsonFrame is the JSON Lines form of a frame. Exactly one of Text and Hex
+// carries the body. Type is a name from typeNames or a number.
+type jsonFrame struct {
+	Offset *int64          `json:"offset,omitempty"`
+	Type   json.RawMessage `json:"type"`
+	Length *int            `json:"length,omitempty"`
+	Text   *string         `json:"text,omitempty"`
+	Hex    *string         `json:"hex,omitempty"`
+}
+
+// MarshalJSON writes string frames, and any other frame with a printable
+// body, as text so the output stays readable. Everything else is hex, as is
+// any string frame that isn't valid UTF-8: JSON would replace the invalid
+// bytes, and the frame wouldn't survive the trip back to TLV.
+func (f Frame) MarshalJSON() ([]byte, error) {
+	name, _ := json.Marshal(f.TypeName())
+	if _, ok := typeNames[f.Type]; !ok {
+		name = []byte(strconv.Itoa(int(f.Type)))
+	}
+
+	offset, length := f.Offset, len(f.Body)
+	jf := jsonFrame{Offset: &offset, Type: name, Length: &length}
+
+	if body := string(f.Body); (f.Type == 2 && utf8.Valid(f.Body)) || (len(f.Body) > 0 && printable(f.Body)) {
+		jf.Text = &body
+	} else {
+		h := hex.EncodeToString(f.Body)
+		jf.Hex = &h
+	}
+
+	return json.Marshal(jf)
+}
+
+// UnmarshalJSON accepts what MarshalJSON produces. Offset and length are
+// optional and ignored, so fixtures can be written by hand.
+func (f *Frame) UnmarshalJSON(b []byte) error {
+	var jf jsonFrame
+
+	err := json.Unmarshal(b, &jf)
+	if err != nil {
+		return err
+	}
+
+	f.Type, err = parseType(jf.Type)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case jf.Text != nil && jf.Hex != nil:
+		return errors.New(`only one of "text" and "hex" may be set`)
+	case jf.Text != nil:
+		f.Body = []byte(*jf.Text)
+	case jf.Hex != nil:
+		f.Body, err = hex.DecodeString(*jf.Hex)
+		if err != nil {
+			return fmt.Errorf("hex: %w", err)
+		}
+	default:
+		f.Body = nil
+	}
+
+	return nil
+}
+
+func parseType(raw json.RawMessage) (uint8, error) {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		for typ, n := range typeNames {
+			if n == name {
+				return typ, nil
+			}
+		}
+
+		return 0, fmt.Errorf("unknown type %q", name)
+	}
+
+	var typ uint8
+	if err := json.Unmarshal(raw, &typ); err != nil {
+		return 0, fmt.Errorf("type must be a name or a number from 0 to 255: %s", raw)
+	}
+
+	return typ, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	fixture := `{"type":"string","text":"Errors are values."}
+{"type":"binary","hex":"deadbeef"}
+{"type":200,"hex":""}
+`
+
+	tlv := new(bytes.Buffer)
+	err := jsonToTLV(strings.NewReader(fixture), tlv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Frame{
+		{Offset: 0, Type: 2, Body: []byte("Errors are values.")},
+		{Offset: 23, Type: 1, Body: []byte{0xde, 0xad, 0xbe, 0xef}},
+		{Offset: 32, Type: 200, Body: []byte{}},
+	}
+
+	fr := NewFrameReader(bytes.NewReader(tlv.Bytes()), 0)
+
+	var actual []Frame
+	for {
+		f, err := fr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual = append(actual, f)
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("frame mismatch:\n%v\n%v", expected, actual)
+	}
+
+	// and back to TLV again
+	*toJSON = true
+	defer func() { *toJSON = false }()
+
+	lines := new(bytes.Buffer)
+	err = dump(NewFrameReader(bytes.NewReader(tlv.Bytes()), 0), lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("\n%s", lines)
+
+	again := new(bytes.Buffer)
+	err = jsonToTLV(lines, again)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(tlv.Bytes(), again.Bytes()) {
+		t.Errorf("round trip mismatch:\n%x\n%x", tlv.Bytes(), again.Bytes())
+	}
+}
+
+func TestJSONRoundTripInvalidUTF8(t *testing.T) {
+	tlv := new(bytes.Buffer)
+	_ = WriteFrame(tlv, Frame{Type: 2, Body: []byte("caf\xe9")}) // Latin-1, not UTF-8
+	_ = WriteFrame(tlv, Frame{Type: 2, Body: []byte{}})
+
+	*toJSON = true
+	defer func() { *toJSON = false }()
+
+	lines := new(bytes.Buffer)
+	err := dump(NewFrameReader(bytes.NewReader(tlv.Bytes()), 0), lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"offset":0,"type":"string","length":4,"hex":"636166e9"}
+{"offset":9,"type":"string","length":0,"text":""}
+`
+
+	if lines.String() != expected {
+		t.Errorf("expected:\n%s\nactual:\n%s", expected, lines)
+	}
+
+	again := new(bytes.Buffer)
+	err = jsonToTLV(lines, again)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(tlv.Bytes(), again.Bytes()) {
+		t.Errorf("round trip mismatch:\n%x\n%x", tlv.Bytes(), again.Bytes())
+	}
+}
+
+func TestDumpTable(t *testing.T) {
+	tlv := new(bytes.Buffer)
+	_ = WriteFrame(tlv, Frame{Type: 2, Body: []byte("Don't panic.")})
+	_ = WriteFrame(tlv, Frame{Type: 1, Body: []byte{0, 1, 2}})
+
+	out := new(bytes.Buffer)
+	err := dump(NewFrameReader(tlv, 0), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `00000000  string            12  "Don't panic."
+00000017  binary             3  000102
+`
+
+	if out.String() != expected {
+		t.Errorf("expected:\n%s\nactual:\n%s", expected, out)
+	}
+}
+
+func TestFrameReaderErrors(t *testing.T) {
+	// truncated body
+	_, err := NewFrameReader(bytes.NewReader([]byte{1, 0, 0, 0, 4, 'a'}), 0).Next()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF; actual: %v", err)
+	}
+
+	// size over the limit, reported once with its offset
+	tlv := new(bytes.Buffer)
+	_ = WriteFrame(tlv, Frame{Type: 1, Body: []byte("ok")})
+	tlv.Write([]byte{1, 0, 0, 1, 0})
+
+	err = dump(NewFrameReader(tlv, 16), io.Discard)
+	if !errors.Is(err, ErrFrameTooLarge) || err.Error() != "offset 7: frame exceeds maximum size (256 > 16)" {
+		t.Errorf("expected ErrFrameTooLarge at offset 7; actual: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+	tlvdump reads a stream of TLV frames and prints one line per frame with
+	its offset, type, length and a preview of the body. The stream can come
+	from a file, stdin, or a live TCP connection, either accepted (-l) or
+	dialed (-d).
+
+	With -json the frames are written as JSON Lines instead, and -from-json
+	does the reverse, turning JSON Lines back into a TLV stream. That makes
+	it easy to write test fixtures by hand:
+
+		$ echo '{"type":"string","text":"Errors are values."}' | tlvdump -from-json > fixture.tlv
+		$ tlvdump fixture.tlv
+		00000000  string            18  "Errors are values."
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+var (
+	listen   = flag.String("l", "", "accept a single TCP connection on this address and dump it")
+	dial     = flag.String("d", "", "dial this TCP address and dump what it sends")
+	toJSON   = flag.Bool("json", false, "write frames as JSON Lines")
+	fromJSON = flag.Bool("from-json", false, "read JSON Lines and write a TLV stream to stdout")
+	forceHex = flag.Bool("x", false, "always preview bodies as hex")
+	preview  = flag.Int("n", 32, "number of body bytes to preview: <= 0 means all")
+	maxFrame = flag.Uint("max", defaultMaxFrame, "largest frame body accepted, in bytes")
+)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: %s [options] [file]\nReads stdin when no file is given.\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	in, err := input()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	defer func() { _ = in.Close() }()
+
+	out := bufio.NewWriter(os.Stdout)
+
+	if *fromJSON {
+		err = jsonToTLV(in, out)
+	} else {
+		err = dump(NewFrameReader(in, uint32(*maxFrame)), out)
+	}
+
+	if fErr := out.Flush(); err == nil {
+		err = fErr
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// input opens whichever source the flags ask for.
+func input() (io.ReadCloser, error) {
+	switch {
+	case *listen != "":
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() { _ = l.Close() }()
+
+		fmt.Fprintf(os.Stderr, "listening on %s ...\n", l.Addr())
+
+		return l.Accept()
+	case *dial != "":
+		return net.Dial("tcp", *dial)
+	case flag.NArg() > 1:
+		return nil, fmt.Errorf("expected at most one file; got %d", flag.NArg())
+	case flag.NArg() == 1 && flag.Arg(0) != "-":
+		return os.Open(flag.Arg(0))
+	default:
+		return io.NopCloser(os.Stdin), nil
+	}
+}
+
+// dump writes each frame from fr to w, as a table row or as JSON.
+func dump(fr *FrameReader, w io.Writer) error {
+	enc := json.NewEncoder(w)
+
+	for {
+		f, err := fr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return fmt.Errorf("offset %d: %w", f.Offset, err)
+		}
+
+		if *toJSON {
+			err = enc.Encode(f)
+		} else {
+			_, err = fmt.Fprintf(w, "%08d  %-10s  %8d  %s\n",
+				f.Offset, f.TypeName(), len(f.Body), f.Preview(*preview, *forceHex))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// jsonToTLV converts JSON Lines read from r into TLV frames written to w.
+func jsonToTLV(r io.Reader, w io.Writer) error {
+	dec := json.NewDecoder(r)
+
+	for line := 1; ; line++ {
+		var f Frame
+
+		err := dec.Decode(&f)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return fmt.Errorf("frame %d: %w", line, err)
+		}
+
+		err = WriteFrame(w, f)
+		if err != nil {
+			return err
+		}
+	}
+}
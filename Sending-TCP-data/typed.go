@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Sender writes values of type T to a stream. T can be a Payload type or
+// anything Marshal understands. It's safe for concurrent use.
+type Sender[T any] struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewSender[T any](w io.Writer) *Sender[T] {
+	return &Sender[T]{w: w}
+}
+
+func (s *Sender[T]) Send(v T) error {
+	p, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = p.WriteTo(s.w)
+
+	return err
+}
+
+// Receiver reads values of type T from a stream, saving callers the type
+// switch on what decode returns. If the peer sends something that doesn't fit
+// in a T, Receive returns an error that matches ErrUnexpectedType.
+// Heartbeats are never returned: see Send.
+type Receiver[T any] struct {
+	// Send, if set, answers the peer's pings with pongs. It has to be safe
+	// to call while the stream is being written to, e.g. PayloadConn.Send.
+	// Without it pings are skipped unanswered.
+	Send func(Payload) error
+
+	dec *Decoder
+}
+
+func NewReceiver[T any](r io.Reader) *Receiver[T] {
+	recv := new(Receiver[T])
+	recv.dec = NewDecoder(r, func(p Payload) error {
+		if recv.Send == nil {
+			return nil
+		}
+
+		return recv.Send(p)
+	})
+
+	return recv
+}
+
+func (r *Receiver[T]) Receive() (T, error) {
+	var v T
+
+	p, err := r.dec.Decode()
+	if err != nil {
+		return v, err
+	}
+
+	err = Unmarshal(p, &v)
+	if err != nil {
+		return v, fmt.Errorf("receiving %T: %w", v, err)
+	}
+
+	return v, nil
+}
+
+// Chan receives values in the background and delivers them on the returned
+// channel, which is closed when the stream ends, a Receive fails or ctx is
+// done. The error, if any, is sent on the second channel; io.EOF isn't
+// reported. Callers have to either drain the channel or cancel ctx, or the
+// goroutine is left blocked on delivering a value. A Receive already waiting
+// on the stream when ctx is done still has to return, e.g. by the connection
+// being closed, before the goroutine exits.
+func (r *Receiver[T]) Chan(ctx context.Context) (<-chan T, <-chan error) {
+	values := make(chan T)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(values)
+		defer close(errs)
+
+		for {
+			v, err := r.Receive()
+			if err != nil {
+				if err != io.EOF {
+					errs <- err
+				}
+
+				return
+			}
+
+			select {
+			case values <- v:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return values, errs
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTypedSenderReceiver(t *testing.T) {
+	client, server := net.Pipe()
+
+	users := []user{
+		{ID: 1, Name: "Clear is better than clever.", Roles: []string{}},
+		{ID: 2, Name: "Don't panic.", Address: &address{City: "London"}, Roles: []string{"writer"}},
+	}
+
+	go func() {
+		defer client.Close()
+
+		s := NewSender[user](client)
+		for _, u := range users {
+			err := s.Send(u)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	values, errs := NewReceiver[user](server).Chan(context.Background())
+
+	var actual []user
+	for u := range values {
+		actual = append(actual, u)
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(users, actual) {
+		t.Errorf("value mismatch:\n%+v\n%+v", users, actual)
+	}
+}
+
+func TestReceiverChanCancel(t *testing.T) {
+	buf := new(bytes.Buffer)
+	s := NewSender[String](buf)
+
+	for _, v := range []String{"Clear is better than clever.", "Don't panic."} {
+		err := s.Send(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	values, errs := NewReceiver[String](buf).Chan(ctx)
+
+	// Nobody reads the values, so the goroutine only gets out by ctx.
+	cancel()
+
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled; actual: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("goroutine still blocked after cancel")
+	}
+
+	for range values {
+	}
+}
+
+func TestReceiverUnexpectedType(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		defer client.Close()
+		_ = NewSender[*Binary](client).Send(&Binary{1, 2, 3})
+	}()
+
+	_, err := NewReceiver[String](server).Receive()
+	if !errors.Is(err, ErrUnexpectedType) {
+		t.Fatalf("expected ErrUnexpectedType; actual: %v", err)
+	}
+
+	t.Log(err)
+}
+
+func TestReceiverAnswersPings(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		defer client.Close()
+
+		_, _ = (&Ping{Seq: 7, Sent: time.Now()}).WriteTo(client)
+		_ = NewSender[String](client).Send("Don't panic.")
+	}()
+
+	var pongs []Payload
+
+	r := NewReceiver[String](server)
+	r.Send = func(p Payload) error {
+		pongs = append(pongs, p)
+		return nil
+	}
+
+	s, err := r.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s != "Don't panic." {
+		t.Errorf("unexpected value: %q", s)
+	}
+
+	if len(pongs) != 1 || pongs[0].(*Pong).Seq != 7 {
+		t.Errorf("expected pong 7; actual: %v", pongs)
+	}
+}
@@ -11,6 +11,19 @@ const (
 	// Declaring types of with a size of 1 byte
 	BinaryType uint8 = iota + 1
 	StingType
+	CompressedType
+	RequestType
+	ResponseType
+	ErrorType
+	MuxType
+	RecordType
+	ListType
+	HelloType
+	AuthType
+	ChunkType
+	TrailerType
+	PingType
+	PongType
 
 	// The 4-byte integer used to designate the Maximum payload size has a
 	// maximum value of 4,294,967,295 indicating a payload of over 4GB. It would
@@ -82,8 +95,8 @@ func (m *Binary) ReadFrom(r io.Reader) (int64, error) {
 		return n, ErrMaxPayloadSize
 	}
 
-	*m = make([]byte, size) // Creating a byte slice the size of the payload
-	o, err := r.Read(*m)    // Reading the actual payload
+	*m = make([]byte, size)      // Creating a byte slice the size of the payload
+	o, err := io.ReadFull(r, *m) // Reading the actual payload
 
 	return n + int64(o), err
 }
@@ -140,7 +153,7 @@ func (m *String) ReadFrom(r io.Reader) (n int64, err error) {
 	}
 
 	buf := make([]byte, size)
-	o, err := r.Read(buf)
+	o, err := io.ReadFull(r, buf)
 	if err != nil {
 		return n, err
 	}
@@ -157,15 +170,15 @@ func decode(r io.Reader) (Payload, error) {
 		return nil, err
 	}
 
-	var payload Payload
+	return decodeType(typ, r)
+}
 
-	switch typ {
-	case BinaryType:
-		payload = new(Binary)
-	case StingType:
-		payload = new(String)
-	default:
-		return nil, errors.New("unknown Type")
+// decodeType decodes the rest of a frame whose type field has already been
+// read.
+func decodeType(typ uint8, r io.Reader) (Payload, error) {
+	payload, err := newPayload(typ)
+	if err != nil {
+		return nil, err
 	}
 
 	// MultiReader is used to inject the byte we've already read i.e the type
@@ -183,5 +196,98 @@ func decode(r io.Reader) (Payload, error) {
 		return nil, err
 	}
 
+	// Compressed frames are unwrapped so callers only ever see the payload
+	// that was originally sent.
+	if c, ok := payload.(*Compressed); ok {
+		return c.Payload, nil
+	}
+
 	return payload, nil
 }
+
+// newPayload returns an empty Payload for the given type field.
+func newPayload(typ uint8) (Payload, error) {
+	switch typ {
+	case BinaryType:
+		return new(Binary), nil
+	case StingType:
+		return new(String), nil
+	case CompressedType:
+		return new(Compressed), nil
+	case RequestType:
+		return new(Request), nil
+	case ResponseType:
+		return new(Response), nil
+	case ErrorType:
+		return new(RPCError), nil
+	case MuxType:
+		return new(MuxFrame), nil
+	case RecordType:
+		return new(Record), nil
+	case ListType:
+		return new(List), nil
+	case HelloType:
+		return new(Hello), nil
+	case AuthType:
+		return new(AuthFrame), nil
+	case ChunkType:
+		return new(Chunk), nil
+	case TrailerType:
+		return new(Trailer), nil
+	case PingType:
+		return new(Ping), nil
+	case PongType:
+		return new(Pong), nil
+	default:
+		return nil, errors.New("unknown Type")
+	}
+}
+
+// writeFrame writes a complete frame, i.e the 1-byte type, the 4-byte size and
+// the body. It's used by the payload types whose body is built up front.
+func writeFrame(w io.Writer, typ uint8, body []byte) (n int64, err error) {
+	if uint64(len(body)) > uint64(MaxPayloadSize) {
+		return 0, ErrMaxPayloadSize
+	}
+
+	err = binary.Write(w, binary.BigEndian, typ)
+	if err != nil {
+		return 0, err
+	}
+
+	n = 1
+
+	err = binary.Write(w, binary.BigEndian, uint32(len(body)))
+	if err != nil {
+		return n, err
+	}
+
+	n += 4
+
+	o, err := w.Write(body)
+
+	return n + int64(o), err
+}
+
+// readFrameBody reads the 4-byte size and the body of a frame whose type has
+// already been consumed. Like the ReadFrom methods, n accounts for the type.
+func readFrameBody(r io.Reader) (n int64, body []byte, err error) {
+	n = 1
+
+	var size uint32
+	err = binary.Read(r, binary.BigEndian, &size)
+	if err != nil {
+		return n, nil, err
+	}
+
+	n += 4
+
+	if size > MaxPayloadSize {
+		return n, nil, ErrMaxPayloadSize
+	}
+
+	body = make([]byte, size)
+	o, err := io.ReadFull(r, body)
+
+	return n + int64(o), body, err
+}
@@ -0,0 +1,188 @@
+/*
+	Package sockopt tunes sockets beyond Go's defaults: keepalive timing,
+	TCP_USER_TIMEOUT, linger, Nagle's algorithm, buffer sizes and TCP Fast
+	Open, as well as SO_REUSEPORT for sharding a listening address across
+	several sockets. The options are set from net.Dialer's and
+	net.ListenConfig's Control hook, before the socket connects or starts
+	listening, so they're in place from the first packet. Connections
+	accepted from a listener inherit the listener's options.
+*/
+package sockopt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+var ErrUnsupported = errors.New("sockopt: not supported on this platform")
+
+// Options are the settings to apply to a socket. The zero value of each field
+// leaves the system default alone. The TCP options are skipped for other
+// networks, so the same Options can be used for UDP sockets' buffers.
+type Options struct {
+	// KeepAliveIdle is how long a connection sits idle before the first
+	// keepalive probe (TCP_KEEPIDLE), KeepAliveInterval the time between
+	// probes (TCP_KEEPINTVL) and KeepAliveCount how many unanswered probes
+	// drop the connection (TCP_KEEPCNT). Setting any of them turns keepalives
+	// on and stops Go from applying its own keepalive defaults. The kernel
+	// works in whole seconds.
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+
+	// UserTimeout is how long sent data may go unacknowledged before the
+	// connection is dropped (TCP_USER_TIMEOUT). Without it, a dead peer
+	// with unacknowledged data outstanding takes around 15 minutes of
+	// retransmissions to notice, whatever the keepalive settings.
+	UserTimeout time.Duration
+
+	// Linger makes Close block for up to Linger while unsent data is
+	// delivered (SO_LINGER). The kernel works in whole seconds.
+	Linger time.Duration
+
+	// ResetOnClose makes Close discard unsent data and send a RST instead
+	// of the usual FIN (SO_LINGER with a zero timeout). It takes precedence
+	// over Linger.
+	ResetOnClose bool
+
+	// Nagle turns Nagle's algorithm back on (TCP_NODELAY off), trading
+	// latency for fewer small packets. Go turns it off for every TCP
+	// connection once it's connected, so this is set after the Control hook
+	// by DialContext and by Listen's Accept.
+	Nagle bool
+
+	// RecvBuffer and SendBuffer size the socket buffers in bytes (SO_RCVBUF,
+	// SO_SNDBUF). Linux doubles the value for its own bookkeeping and caps
+	// it at net.core.rmem_max and wmem_max.
+	RecvBuffer int
+	SendBuffer int
+
+	// FastOpen turns on TCP Fast Open, which lets data ride on the SYN of a
+	// repeat connection. For listeners it's the length of the queue of
+	// connections still completing their handshake (TCP_FASTOPEN); dialers
+	// only check that it's positive (TCP_FASTOPEN_CONNECT).
+	FastOpen int
+
+	// ReusePort lets several sockets bind the same address (SO_REUSEPORT),
+	// with the kernel spreading connections or datagrams across them.
+	// ListenShards and ListenPacketShards set it for you. Darwin and the
+	// BSDs support it too, along with RecvBuffer and SendBuffer, but their
+	// kernels don't balance the load: one socket tends to get everything.
+	ReusePort bool
+}
+
+// Dialer returns a net.Dialer that applies o to the sockets it dials.
+func (o *Options) Dialer() *net.Dialer {
+	return &net.Dialer{Control: o.control(false), KeepAlive: o.goKeepAlive()}
+}
+
+// ListenConfig returns a net.ListenConfig that applies o to the sockets it
+// listens on, and so to the connections they accept.
+func (o *Options) ListenConfig() *net.ListenConfig {
+	return &net.ListenConfig{Control: o.control(true), KeepAlive: o.goKeepAlive()}
+}
+
+// DialContext dials address with the options applied. It has the signature
+// of ch03.DialFunc, so it can be plugged into the dialers and the Pool there.
+func (o *Options) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := o.Dialer().DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := o.afterConnect(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Listen listens on address with the options applied.
+func (o *Options) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	l, err := o.ListenConfig().Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if !o.Nagle {
+		return l, nil
+	}
+
+	return &listener{Listener: l, opts: o}, nil
+}
+
+// listener sets the options Go overrides on each accepted connection.
+type listener struct {
+	net.Listener
+	opts *Options
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.opts.afterConnect(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// afterConnect sets the options Go overrides once a TCP connection is up.
+func (o *Options) afterConnect(conn net.Conn) error {
+	if tcp, ok := conn.(*net.TCPConn); ok && o.Nagle {
+		return tcp.SetNoDelay(false)
+	}
+
+	return nil
+}
+
+// goKeepAlive is the KeepAlive for the net.Dialer or net.ListenConfig: -1
+// stops Go overwriting keepalive settings made by the Control hook.
+func (o *Options) goKeepAlive() time.Duration {
+	if o.keepAlive() {
+		return -1
+	}
+
+	return 0
+}
+
+func (o *Options) keepAlive() bool {
+	return o.KeepAliveIdle > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0
+}
+
+func (o *Options) control(listening bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, _ string, c syscall.RawConn) error {
+		var err error
+
+		cErr := c.Control(func(fd uintptr) {
+			err = o.set(int(fd), network, listening)
+		})
+		if cErr != nil {
+			return cErr
+		}
+
+		return err
+	}
+}
+
+// seconds rounds d up to whole seconds, the unit most socket options use.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+func isTCP(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	default:
+		return false
+	}
+}
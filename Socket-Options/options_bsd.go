@@ -0,0 +1,49 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package sockopt
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// set applies o to the socket fd. Only ReusePort and the buffer sizes are
+// supported here; the rest of the options are Linux's.
+func (o *Options) set(fd int, _ string, _ bool) error {
+	rest := *o
+	rest.ReusePort, rest.RecvBuffer, rest.SendBuffer = false, 0, 0
+
+	if rest != (Options{}) {
+		return ErrUnsupported
+	}
+
+	if o.RecvBuffer > 0 {
+		if err := setInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, "SO_RCVBUF", o.RecvBuffer); err != nil {
+			return err
+		}
+	}
+
+	if o.SendBuffer > 0 {
+		if err := setInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, "SO_SNDBUF", o.SendBuffer); err != nil {
+			return err
+		}
+	}
+
+	if o.ReusePort {
+		if err := setInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, "SO_REUSEPORT", 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setInt(fd, level, opt int, name string, value int) error {
+	if err := unix.SetsockoptInt(fd, level, opt, value); err != nil {
+		return fmt.Errorf("sockopt: set %s: %w", name, err)
+	}
+
+	return nil
+}
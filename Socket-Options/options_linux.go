@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+package sockopt
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// set applies o to the socket fd. It runs before the socket is bound.
+func (o *Options) set(fd int, network string, listening bool) error {
+	if o.RecvBuffer > 0 {
+		if err := setInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, "SO_RCVBUF", o.RecvBuffer); err != nil {
+			return err
+		}
+	}
+
+	if o.SendBuffer > 0 {
+		if err := setInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, "SO_SNDBUF", o.SendBuffer); err != nil {
+			return err
+		}
+	}
+
+	if o.ReusePort {
+		if err := setInt(fd, syscall.SOL_SOCKET, unix.SO_REUSEPORT, "SO_REUSEPORT", 1); err != nil {
+			return err
+		}
+	}
+
+	if !isTCP(network) {
+		return nil
+	}
+
+	if o.keepAlive() {
+		if err := setInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, "SO_KEEPALIVE", 1); err != nil {
+			return err
+		}
+	}
+
+	if o.KeepAliveIdle > 0 {
+		if err := setInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, "TCP_KEEPIDLE", seconds(o.KeepAliveIdle)); err != nil {
+			return err
+		}
+	}
+
+	if o.KeepAliveInterval > 0 {
+		if err := setInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, "TCP_KEEPINTVL", seconds(o.KeepAliveInterval)); err != nil {
+			return err
+		}
+	}
+
+	if o.KeepAliveCount > 0 {
+		if err := setInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, "TCP_KEEPCNT", o.KeepAliveCount); err != nil {
+			return err
+		}
+	}
+
+	if o.UserTimeout > 0 {
+		if err := setInt(fd, syscall.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, "TCP_USER_TIMEOUT", int(o.UserTimeout.Milliseconds())); err != nil {
+			return err
+		}
+	}
+
+	if o.ResetOnClose || o.Linger > 0 {
+		l := &syscall.Linger{Onoff: 1}
+		if !o.ResetOnClose {
+			l.Linger = int32(seconds(o.Linger))
+		}
+
+		if err := syscall.SetsockoptLinger(fd, syscall.SOL_SOCKET, syscall.SO_LINGER, l); err != nil {
+			return fmt.Errorf("sockopt: set SO_LINGER: %w", err)
+		}
+	}
+
+	if o.FastOpen > 0 {
+		if listening {
+			return setInt(fd, syscall.IPPROTO_TCP, unix.TCP_FASTOPEN, "TCP_FASTOPEN", o.FastOpen)
+		}
+
+		return setInt(fd, syscall.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, "TCP_FASTOPEN_CONNECT", 1)
+	}
+
+	return nil
+}
+
+func setInt(fd, level, opt int, name string, value int) error {
+	if err := syscall.SetsockoptInt(fd, level, opt, value); err != nil {
+		return fmt.Errorf("sockopt: set %s: %w", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+//go:build linux
+// +build linux
+
+package sockopt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sockopts reads options off conn's socket.
+type sockopts struct {
+	t  *testing.T
+	fd int
+}
+
+// inspect calls f with conn's socket, which is only valid during the call.
+func inspect(t *testing.T, conn syscall.Conn, f func(s *sockopts)) {
+	t.Helper()
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = rc.Control(func(fd uintptr) { f(&sockopts{t: t, fd: int(fd)}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *sockopts) int(level, opt int) int {
+	s.t.Helper()
+
+	v, err := syscall.GetsockoptInt(s.fd, level, opt)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	return v
+}
+
+func (s *sockopts) linger() unix.Linger {
+	s.t.Helper()
+
+	l, err := unix.GetsockoptLinger(s.fd, unix.SOL_SOCKET, unix.SO_LINGER)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	return *l
+}
+
+func (s *sockopts) check(name string, level, opt, expected int) {
+	s.t.Helper()
+
+	if actual := s.int(level, opt); actual != expected {
+		s.t.Errorf("%s: expected %d; actual: %d", name, expected, actual)
+	}
+}
+
+var tuned = Options{
+	KeepAliveIdle:     30 * time.Second,
+	KeepAliveInterval: 10 * time.Second,
+	KeepAliveCount:    4,
+	UserTimeout:       5 * time.Second,
+	Linger:            1500 * time.Millisecond,
+	Nagle:             true,
+	RecvBuffer:        32 << 10,
+	SendBuffer:        48 << 10,
+	FastOpen:          16,
+}
+
+// checkTuned checks a connection's socket against tuned.
+func checkTuned(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	inspect(t, conn.(syscall.Conn), func(s *sockopts) {
+		s.check("SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
+		s.check("TCP_KEEPIDLE", syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, 30)
+		s.check("TCP_KEEPINTVL", syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, 10)
+		s.check("TCP_KEEPCNT", syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 4)
+		s.check("TCP_USER_TIMEOUT", syscall.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, 5000)
+		s.check("TCP_NODELAY", syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 0)
+
+		// Linux doubles the buffer sizes.
+		s.check("SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, 2*tuned.RecvBuffer)
+		s.check("SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, 2*tuned.SendBuffer)
+
+		if l := s.linger(); l.Onoff != 1 || l.Linger != 2 {
+			t.Errorf("SO_LINGER: expected on for 2s; actual: %+v", l)
+		}
+	})
+}
+
+func TestOptions(t *testing.T) {
+	ctx := context.Background()
+
+	l, err := tuned.Listen(ctx, "tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	inspect(t, l.(*listener).Listener.(syscall.Conn), func(s *sockopts) {
+		s.check("TCP_FASTOPEN", syscall.IPPROTO_TCP, unix.TCP_FASTOPEN, tuned.FastOpen)
+	})
+
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+
+		accepted <- conn
+	}()
+
+	client, err := tuned.DialContext(ctx, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server := <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+
+	t.Run("dialed", func(t *testing.T) {
+		checkTuned(t, client)
+
+		inspect(t, client.(syscall.Conn), func(s *sockopts) {
+			s.check("TCP_FASTOPEN_CONNECT", syscall.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		})
+	})
+
+	t.Run("accepted", func(t *testing.T) {
+		checkTuned(t, server)
+	})
+}
+
+func TestOptionsDefaults(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var none Options
+
+	conn, err := none.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Go's own defaults are left alone.
+	inspect(t, conn.(syscall.Conn), func(s *sockopts) {
+		s.check("TCP_NODELAY", syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+		s.check("SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
+		s.check("TCP_USER_TIMEOUT", syscall.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, 0)
+
+		if l := s.linger(); l.Onoff != 0 {
+			t.Errorf("SO_LINGER: expected off; actual: %+v", l)
+		}
+	})
+}
+
+func TestOptionsResetOnClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	opts := Options{ResetOnClose: true, Linger: time.Minute}
+
+	client, err := opts.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	inspect(t, client.(syscall.Conn), func(s *sockopts) {
+		if l := s.linger(); l.Onoff != 1 || l.Linger != 0 {
+			t.Errorf("SO_LINGER: expected on with no timeout; actual: %+v", l)
+		}
+	})
+
+	_ = client.Close()
+
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("expected the peer to see a reset; actual: %v", err)
+	}
+}
+
+func TestOptionsUDP(t *testing.T) {
+	opts := Options{RecvBuffer: 64 << 10, KeepAliveIdle: time.Second, Nagle: true}
+
+	conn, err := opts.ListenConfig().ListenPacket(context.Background(), "udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The TCP options don't apply and aren't attempted.
+	inspect(t, conn.(syscall.Conn), func(s *sockopts) {
+		s.check("SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, 2*opts.RecvBuffer)
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package sockopt
+
+// set fails unless there's nothing to set: the options are Linux's, and
+// Darwin's and the BSDs' for the few they share.
+func (o *Options) set(fd int, network string, listening bool) error {
+	if *o != (Options{}) {
+		return ErrUnsupported
+	}
+
+	return nil
+}
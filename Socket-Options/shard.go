@@ -0,0 +1,68 @@
+package sockopt
+
+import (
+	"context"
+	"net"
+)
+
+// ListenShards opens n listeners on the same address with SO_REUSEPORT. The
+// kernel hands each new connection to one of them, so giving each its own
+// accept loop spreads accepting across cores instead of funnelling every
+// connection through one goroutine. If address has port 0, all n share the
+// port picked for the first.
+func (o *Options) ListenShards(ctx context.Context, network, address string, n int) ([]net.Listener, error) {
+	opts := *o
+	opts.ReusePort = true
+
+	if n < 1 {
+		n = 1
+	}
+
+	listeners := make([]net.Listener, 0, n)
+
+	for i := 0; i < n; i++ {
+		l, err := opts.Listen(ctx, network, address)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+
+			return nil, err
+		}
+
+		listeners = append(listeners, l)
+		address = l.Addr().String()
+	}
+
+	return listeners, nil
+}
+
+// ListenPacketShards is ListenShards for datagram sockets: the kernel
+// spreads incoming datagrams across n sockets by their source address, each
+// of which should have its own read loop.
+func (o *Options) ListenPacketShards(ctx context.Context, network, address string, n int) ([]net.PacketConn, error) {
+	opts := *o
+	opts.ReusePort = true
+
+	if n < 1 {
+		n = 1
+	}
+
+	conns := make([]net.PacketConn, 0, n)
+
+	for i := 0; i < n; i++ {
+		pc, err := opts.ListenConfig().ListenPacket(ctx, network, address)
+		if err != nil {
+			for _, pc := range conns {
+				_ = pc.Close()
+			}
+
+			return nil, err
+		}
+
+		conns = append(conns, pc)
+		address = pc.LocalAddr().String()
+	}
+
+	return conns, nil
+}
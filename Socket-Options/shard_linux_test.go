@@ -0,0 +1,146 @@
+//go:build linux
+// +build linux
+
+package sockopt
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const shards = 4
+
+func TestListenShards(t *testing.T) {
+	var opts Options
+
+	listeners, err := opts.ListenShards(context.Background(), "tcp", "127.0.0.1:", shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listeners[0].Addr().String()
+	accepted := make(chan int)
+
+	for i, l := range listeners {
+		defer l.Close()
+
+		if actual := l.Addr().String(); actual != addr {
+			t.Fatalf("expected every shard on %s; actual: %s", addr, actual)
+		}
+
+		inspect(t, l.(syscall.Conn), func(s *sockopts) {
+			s.check("SO_REUSEPORT", syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+
+		go func(i int, l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+
+				_ = conn.Close()
+				accepted <- i
+			}
+		}(i, l)
+	}
+
+	// Without SO_REUSEPORT the address is taken.
+	if _, err := opts.Listen(context.Background(), "tcp", addr); err == nil {
+		t.Error("expected a plain listener on the same address to fail")
+	}
+
+	const conns = 64
+
+	for i := 0; i < conns; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = conn.Close()
+	}
+
+	checkSpread(t, accepted, conns)
+}
+
+func TestListenPacketShards(t *testing.T) {
+	var opts Options
+
+	conns, err := opts.ListenPacketShards(context.Background(), "udp", "127.0.0.1:", shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := conns[0].LocalAddr().String()
+	received := make(chan int)
+
+	for i, pc := range conns {
+		defer pc.Close()
+
+		go func(i int, pc net.PacketConn) {
+			buf := make([]byte, 16)
+
+			for {
+				if _, _, err := pc.ReadFrom(buf); err != nil {
+					return
+				}
+
+				received <- i
+			}
+		}(i, pc)
+	}
+
+	const clients = 64
+
+	// Datagrams are spread by source address, so each comes from its own
+	// socket.
+	for i := 0; i < clients; i++ {
+		client, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.Write([]byte("hello"))
+		_ = client.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkSpread(t, received, clients)
+}
+
+// checkSpread collects the shard indexes of n events and checks that more
+// than one shard had a share.
+func checkSpread(t *testing.T, events <-chan int, n int) {
+	t.Helper()
+
+	counts := make([]int, shards)
+
+	for i := 0; i < n; i++ {
+		select {
+		case shard := <-events:
+			counts[shard]++
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d events; actual: %d", n, i)
+		}
+	}
+
+	used := 0
+	for _, c := range counts {
+		if c > 0 {
+			used++
+		}
+	}
+
+	if used < 2 {
+		t.Errorf("expected the kernel to spread the load; actual: %v", counts)
+	}
+}
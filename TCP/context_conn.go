@@ -0,0 +1,109 @@
+package ch03
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo is a deadline that's already passed, which makes a blocked
+// Read or Write return at once.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ContextConn lets each Read and Write be bounded by a context instead of by
+// juggling SetDeadline at every call site. The context's deadline becomes
+// the socket deadline, and canceling the context interrupts a Read or Write
+// that's blocked, the same way a past deadline does.
+//
+// ReadContext and WriteContext own the read and write deadlines
+// respectively, so they mustn't be mixed with SetReadDeadline or
+// SetWriteDeadline on the same direction.
+type ContextConn struct {
+	net.Conn
+
+	rmu sync.Mutex
+	wmu sync.Mutex
+}
+
+func NewContextConn(conn net.Conn) *ContextConn {
+	return &ContextConn{Conn: conn}
+}
+
+// ReadContext reads like Read, giving up when ctx is done. If data arrives
+// just as ctx is canceled, the data wins: it's returned without an error,
+// so nothing read from the socket is lost.
+func (c *ContextConn) ReadContext(ctx context.Context, b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	return doContext(ctx, c.Conn.SetReadDeadline, func() (int, error) {
+		return c.Conn.Read(b)
+	})
+}
+
+// WriteContext writes like Write, giving up when ctx is done. As with any
+// timed-out write, part of b may have been sent; n says how much.
+func (c *ContextConn) WriteContext(ctx context.Context, b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return doContext(ctx, c.Conn.SetWriteDeadline, func() (int, error) {
+		return c.Conn.Write(b)
+	})
+}
+
+func doContext(ctx context.Context, setDeadline func(time.Time) error, op func() (int, error)) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	deadline, _ := ctx.Deadline() // the zero time, i.e. no deadline, if unset
+	if err := setDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	// Leave the conn without a deadline for whoever uses it next, in
+	// particular if the watcher below moved it into the past.
+	defer func() { _ = setDeadline(time.Time{}) }()
+
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+
+		go func() {
+			defer close(stopped)
+
+			select {
+			case <-ctx.Done():
+				_ = setDeadline(aLongTimeAgo)
+			case <-stop:
+			}
+		}()
+
+		// The watcher has to be gone before the deferred reset above runs,
+		// otherwise it could still move the deadline afterwards.
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+
+	n, err := op()
+
+	// Timeouts are reported as the context's error, including the socket
+	// deadline expiring a moment before ctx itself notices its deadline.
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return n, ctxErr
+		}
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return n, context.DeadlineExceeded
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,153 @@
+package ch03
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestContextConnCancelInterruptsRead(t *testing.T) {
+	client, _ := tcpPair(t)
+	conn := NewContextConn(client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+
+	_, err := conn.ReadContext(ctx, make([]byte, 1))
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled; actual: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("read wasn't interrupted promptly: %s", elapsed)
+	}
+}
+
+func TestContextConnDeadline(t *testing.T) {
+	client, server := tcpPair(t)
+	conn := NewContextConn(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := conn.ReadContext(ctx, make([]byte, 1))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded; actual: %v", err)
+	}
+
+	// The deadline doesn't outlive the call.
+	go func() { _, _ = server.Write([]byte("x")) }()
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = conn.Read(make([]byte, 1))
+	if err != nil {
+		t.Errorf("expected plain Read to work afterwards; actual: %v", err)
+	}
+}
+
+func TestContextConnCancelInterruptsWrite(t *testing.T) {
+	// Writes to a pipe block until the other end reads, which it never does.
+	client, server := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	conn := NewContextConn(client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	n, err := conn.WriteContext(ctx, []byte("ping"))
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled; actual: %v", err)
+	}
+
+	if n != 0 {
+		t.Errorf("expected nothing written; actual: %d bytes", n)
+	}
+}
+
+func TestContextConnAlreadyCanceled(t *testing.T) {
+	client, _ := tcpPair(t)
+	conn := NewContextConn(client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := conn.WriteContext(ctx, []byte("ping"))
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled; actual: %v", err)
+	}
+}
+
+// TestContextConnCancelRace cancels reads at the same moment data arrives.
+// Whichever wins, no byte may be lost or repeated.
+func TestContextConnCancelRace(t *testing.T) {
+	client, server := tcpPair(t)
+	conn := NewContextConn(client)
+
+	const count = 200
+
+	go func() {
+		for i := 0; i < count; i++ {
+			_, err := server.Write([]byte{byte(i)})
+			if err != nil {
+				return
+			}
+
+			time.Sleep(time.Duration(i%3) * 100 * time.Microsecond)
+		}
+	}()
+
+	buf := make([]byte, 1)
+	var canceled int
+
+	for i := 0; i < count; {
+		ctx, cancel := context.WithCancel(context.Background())
+		delay := time.Duration(i%5) * 50 * time.Microsecond
+
+		go func() {
+			time.Sleep(delay)
+			cancel()
+		}()
+
+		n, err := conn.ReadContext(ctx, buf)
+		cancel()
+
+		switch {
+		case n == 1:
+			if buf[0] != byte(i) {
+				t.Fatalf("expected byte %d; actual: %d", i, buf[0])
+			}
+
+			i++
+		case err == context.Canceled:
+			canceled++
+		default:
+			t.Fatalf("read %d: unexpected n=%d err=%v", i, n, err)
+		}
+	}
+
+	t.Logf("%d reads canceled", canceled)
+
+	// The conn still works normally after all that.
+	go func() { _, _ = server.Write([]byte("done")) }()
+
+	done := make([]byte, 4)
+	_, err := io.ReadFull(conn, done)
+	if err != nil || string(done) != "done" {
+		t.Errorf("expected %q; actual: %q, %v", "done", done, err)
+	}
+}
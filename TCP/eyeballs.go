@@ -0,0 +1,269 @@
+package ch03
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultAttemptDelay is the delay between connection attempts RFC 8305
+// recommends.
+const defaultAttemptDelay = 250 * time.Millisecond
+
+var ErrNoAddresses = errors.New("dial: no addresses to connect to")
+
+// Resolver looks up a host's addresses. *net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DialFunc has the signature of net.Dialer's DialContext.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Attempt describes one connection attempt made by an EyeballsDialer.
+type Attempt struct {
+	Address  string
+	Start    time.Duration // since the dial began
+	Duration time.Duration // from Start until the attempt finished
+	Err      error         // why the attempt failed; context.Canceled if cut short by the winner
+	Won      bool
+}
+
+// EyeballsDialer dials every address a host resolves to, racing them with
+// staggered starts as described by RFC 8305 (Happy Eyeballs v2). Rather
+// than waiting for an unreachable address to time out, the next attempt
+// starts after AttemptDelay, or straight away if the current one fails.
+// The first connection wins and every other attempt is canceled.
+//
+// Unlike the RFC, both address families are looked up with a single query
+// rather than racing separate AAAA and A lookups.
+type EyeballsDialer struct {
+	// Resolver defaults to net.DefaultResolver.
+	Resolver Resolver
+
+	// Dial makes each individual attempt. It defaults to a net.Dialer.
+	Dial DialFunc
+
+	// AttemptDelay is how long an attempt gets before the next one starts.
+	// It defaults to 250ms.
+	AttemptDelay time.Duration
+}
+
+// DialContext connects to address on the named network, which must be tcp,
+// tcp4 or tcp6. The lookup and every attempt are reported to the DialTrace in
+// ctx, if any. Alongside the connection, it returns the attempts it made in
+// the order they were started, which is useful whether the dial succeeded
+// or not.
+func (d *EyeballsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, []Attempt, error) {
+	addrs, err := d.resolve(ctx, network, address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dial, delay := d.Dial, d.AttemptDelay
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	if delay <= 0 {
+		delay = defaultAttemptDelay
+	}
+
+	type result struct {
+		i        int
+		conn     net.Conn
+		err      error
+		end      time.Time
+		canceled bool // ctx was done by the time the attempt returned
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		start    = time.Now()
+		attempts = make([]Attempt, len(addrs))
+		results  = make(chan result, len(addrs))
+		next     int
+		running  int
+	)
+
+	launch := func() {
+		i := next
+		next++
+		running++
+
+		attempts[i] = Attempt{Address: addrs[i], Start: time.Since(start)}
+
+		go func() {
+			trace := ContextDialTrace(ctx)
+			trace.connectStart(network, addrs[i])
+			conn, err := dial(ctx, network, addrs[i])
+			trace.connectDone(network, addrs[i], err)
+
+			results <- result{i: i, conn: conn, err: err, end: time.Now(), canceled: ctx.Err() != nil}
+		}()
+	}
+
+	record := func(r result) {
+		a := &attempts[r.i]
+		a.Duration = r.end.Sub(start) - a.Start
+		a.Err = r.err
+	}
+
+	launch()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	restartTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		timer.Reset(delay)
+	}
+
+	var firstErr error
+
+	for running > 0 {
+		select {
+		case <-timer.C:
+			if next < len(addrs) && ctx.Err() == nil {
+				launch()
+				timer.Reset(delay)
+			}
+		case r := <-results:
+			running--
+			record(r)
+
+			if r.err == nil {
+				attempts[r.i].Won = true
+
+				// Cancel the losers and wait for them, closing any that
+				// connected in the meantime. Those still running when the
+				// winner was chosen lost because of it, whatever they ran
+				// into on their way out; those that had already failed
+				// keep their own error.
+				cancel()
+
+				for ; running > 0; running-- {
+					loser := <-results
+					record(loser)
+
+					if loser.conn != nil || loser.canceled {
+						attempts[loser.i].Err = context.Canceled
+					}
+
+					if loser.conn != nil {
+						_ = loser.conn.Close()
+					}
+				}
+
+				return r.conn, attempts[:next], nil
+			}
+
+			if firstErr == nil {
+				firstErr = r.err
+			}
+
+			// A failed attempt hands over to the next one immediately.
+			if next < len(addrs) && ctx.Err() == nil {
+				launch()
+				restartTimer()
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, attempts[:next], err
+	}
+
+	return nil, attempts[:next], firstErr
+}
+
+// resolve returns the addresses to try, in the order to try them.
+func (d *EyeballsDialer) resolve(ctx context.Context, network, address string) ([]string, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IPAddr
+
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IPAddr{{IP: ip}}
+	} else {
+		resolver := d.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+
+		trace := ContextDialTrace(ctx)
+		trace.dnsStart(host)
+		ips, err = resolver.LookupIPAddr(ctx, host)
+		trace.dnsDone(ips, err)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var addrs []string
+
+	for _, ip := range interleaveFamilies(ips) {
+		if !matchesFamily(network, ip) {
+			continue
+		}
+
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%w: %s has no %s addresses", ErrNoAddresses, host, network)
+	}
+
+	return addrs, nil
+}
+
+// interleaveFamilies orders ips the way RFC 8305 section 4 asks: IPv6 first,
+// then alternating between the families, keeping the resolver's order
+// within each family.
+func interleaveFamilies(ips []net.IPAddr) []net.IPAddr {
+	var v6, v4 []net.IPAddr
+
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	out := make([]net.IPAddr, 0, len(ips))
+
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			out = append(out, v6[0])
+			v6 = v6[1:]
+		}
+
+		if len(v4) > 0 {
+			out = append(out, v4[0])
+			v4 = v4[1:]
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,308 @@
+package ch03
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// staticResolver resolves every host to the same addresses.
+type staticResolver []string
+
+func (r staticResolver) LookupIPAddr(context.Context, string) ([]net.IPAddr, error) {
+	var ips []net.IPAddr
+	for _, s := range r {
+		ips = append(ips, net.IPAddr{IP: net.ParseIP(s)})
+	}
+
+	return ips, nil
+}
+
+// loopbackListeners listens on the same port on each of ips, which all have
+// to be loopback addresses, and returns that port.
+func loopbackListeners(t *testing.T, ips ...string) string {
+	t.Helper()
+
+	var port string
+
+	for _, ip := range ips {
+		listener, err := net.Listen("tcp", net.JoinHostPort(ip, port))
+		if err != nil {
+			t.Skipf("can't listen on %s: %v", ip, err)
+		}
+
+		t.Cleanup(func() { listener.Close() })
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+
+				conn.Close()
+			}
+		}()
+
+		_, port, _ = net.SplitHostPort(listener.Addr().String())
+	}
+
+	return port
+}
+
+// delayedDial dials for real after waiting the delay configured for the
+// address's IP, and records the order of the attempts.
+type delayedDial struct {
+	delays map[string]time.Duration
+
+	mu    sync.Mutex
+	order []string
+}
+
+func (d *delayedDial) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.order = append(d.order, address)
+	d.mu.Unlock()
+
+	host, _, _ := net.SplitHostPort(address)
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(d.delays[host]):
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+func TestEyeballsStaggeredStart(t *testing.T) {
+	port := loopbackListeners(t, "127.0.0.1", "127.0.0.2", "127.0.0.3")
+
+	// The first two addresses are slow, the third isn't.
+	dial := &delayedDial{delays: map[string]time.Duration{
+		"127.0.0.1": 5 * time.Second,
+		"127.0.0.2": 5 * time.Second,
+	}}
+
+	d := &EyeballsDialer{
+		Resolver:     staticResolver{"127.0.0.1", "127.0.0.2", "127.0.0.3"},
+		Dial:         dial.DialContext,
+		AttemptDelay: 50 * time.Millisecond,
+	}
+
+	start := time.Now()
+
+	conn, attempts, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("example.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the fast address to win quickly; took %s", elapsed)
+	}
+
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.3" {
+		t.Errorf("expected 127.0.0.3 to win; actual: %s", host)
+	}
+
+	if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts; actual: %d", len(attempts))
+	}
+
+	for i, a := range attempts {
+		t.Logf("%s started at %s, took %s: %v", a.Address, a.Start, a.Duration, a.Err)
+
+		if earliest := time.Duration(i) * 50 * time.Millisecond; a.Start < earliest {
+			t.Errorf("attempt %d started too early: %s", i, a.Start)
+		}
+	}
+
+	if !attempts[2].Won || attempts[2].Err != nil {
+		t.Errorf("expected the last attempt to win; actual: %+v", attempts[2])
+	}
+
+	for _, a := range attempts[:2] {
+		if a.Won || !errors.Is(a.Err, context.Canceled) {
+			t.Errorf("expected losing attempt to be canceled; actual: %+v", a)
+		}
+	}
+}
+
+func TestEyeballsLosersReportCanceled(t *testing.T) {
+	// Like net.Dialer, the slow attempt doesn't return ctx's own error when
+	// it's canceled.
+	dial := func(ctx context.Context, _, address string) (net.Conn, error) {
+		if host, _, _ := net.SplitHostPort(address); host == "127.0.0.2" {
+			client, server := net.Pipe()
+			server.Close()
+
+			return client, nil
+		}
+
+		<-ctx.Done()
+
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("operation was canceled")}
+	}
+
+	d := &EyeballsDialer{
+		Resolver:     staticResolver{"127.0.0.1", "127.0.0.2"},
+		Dial:         dial,
+		AttemptDelay: 10 * time.Millisecond,
+	}
+
+	conn, attempts, err := d.DialContext(context.Background(), "tcp", "example.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if len(attempts) != 2 || !attempts[1].Won {
+		t.Fatalf("expected the second attempt to win; actual: %+v", attempts)
+	}
+
+	if a := attempts[0]; a.Won || a.Err != context.Canceled {
+		t.Errorf("expected the loser to report context.Canceled; actual: %+v", a)
+	}
+}
+
+func TestEyeballsFinishedLosersKeepErrors(t *testing.T) {
+	refused := errors.New("refused")
+	release, failed := make(chan struct{}), make(chan struct{})
+
+	// The first attempt is refused while the second is connecting, so
+	// however the two results are ordered, the refusal came before the win.
+	dial := func(ctx context.Context, _, address string) (net.Conn, error) {
+		if host, _, _ := net.SplitHostPort(address); host == "127.0.0.1" {
+			<-release
+			close(failed)
+
+			return nil, refused
+		}
+
+		close(release)
+		<-failed
+		time.Sleep(50 * time.Millisecond)
+
+		client, server := net.Pipe()
+		server.Close()
+
+		return client, nil
+	}
+
+	d := &EyeballsDialer{
+		Resolver:     staticResolver{"127.0.0.1", "127.0.0.2"},
+		Dial:         dial,
+		AttemptDelay: 10 * time.Millisecond,
+	}
+
+	conn, attempts, err := d.DialContext(context.Background(), "tcp", "example.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if len(attempts) != 2 || !attempts[1].Won {
+		t.Fatalf("expected the second attempt to win; actual: %+v", attempts)
+	}
+
+	if a := attempts[0]; a.Err != refused {
+		t.Errorf("expected the first attempt's own error; actual: %+v", a)
+	}
+}
+
+func TestEyeballsFailureStartsNextAttempt(t *testing.T) {
+	port := loopbackListeners(t, "127.0.0.1")
+
+	// Nothing listens on 127.0.0.4, so that attempt is refused at once and
+	// the next shouldn't wait out the attempt delay.
+	d := &EyeballsDialer{
+		Resolver:     staticResolver{"127.0.0.4", "127.0.0.1"},
+		AttemptDelay: 5 * time.Second,
+	}
+
+	conn, attempts, err := d.DialContext(context.Background(), "tcp4", net.JoinHostPort("example.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if len(attempts) != 2 {
+		t.Fatalf("expected 2 attempts; actual: %d", len(attempts))
+	}
+
+	if attempts[0].Err == nil {
+		t.Error("expected first attempt to fail")
+	}
+
+	if attempts[1].Start > time.Second {
+		t.Errorf("expected second attempt right after the first failed; started at %s", attempts[1].Start)
+	}
+}
+
+func TestEyeballsAllFail(t *testing.T) {
+	refused := errors.New("refused")
+
+	d := &EyeballsDialer{
+		Resolver: staticResolver{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2"},
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			return nil, refused
+		},
+	}
+
+	_, attempts, err := d.DialContext(context.Background(), "tcp", "example.test:7")
+	if err != refused {
+		t.Fatalf("expected the first attempt's error; actual: %v", err)
+	}
+
+	// IPv6 first, then alternating families.
+	expected := []string{"[2001:db8::1]:7", "192.0.2.1:7", "[2001:db8::2]:7", "192.0.2.2:7"}
+
+	if len(attempts) != len(expected) {
+		t.Fatalf("expected %d attempts; actual: %d", len(expected), len(attempts))
+	}
+
+	for i, a := range attempts {
+		if a.Address != expected[i] {
+			t.Errorf("attempt %d: expected %s; actual: %s", i, expected[i], a.Address)
+		}
+	}
+}
+
+func TestEyeballsContextDeadline(t *testing.T) {
+	dial := &delayedDial{delays: map[string]time.Duration{
+		"127.0.0.1": 5 * time.Second,
+		"127.0.0.2": 5 * time.Second,
+	}}
+
+	d := &EyeballsDialer{
+		Resolver:     staticResolver{"127.0.0.1", "127.0.0.2"},
+		Dial:         dial.DialContext,
+		AttemptDelay: 10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, attempts, err := d.DialContext(ctx, "tcp", "example.test:7")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded; actual: %v", err)
+	}
+
+	if len(attempts) != 2 {
+		t.Errorf("expected both addresses attempted; actual: %d", len(attempts))
+	}
+}
+
+func TestEyeballsNoAddresses(t *testing.T) {
+	d := &EyeballsDialer{Resolver: staticResolver{"2001:db8::1"}}
+
+	_, _, err := d.DialContext(context.Background(), "tcp4", "example.test:7")
+	if !errors.Is(err, ErrNoAddresses) {
+		t.Errorf("expected ErrNoAddresses; actual: %v", err)
+	}
+}
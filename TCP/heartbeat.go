@@ -0,0 +1,152 @@
+package ch03
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	defaultPongTimeout = 10 * time.Second
+	defaultMaxMisses   = 3
+)
+
+var ErrHeartbeatTimeout = errors.New("heartbeat: peer stopped answering pings")
+
+// Heartbeat detects dead peers. Pinging alone won't notice a half-open
+// connection, since writes to it keep succeeding until the send buffer
+// fills, so Heartbeat also expects every ping to be answered within
+// Timeout. Once MaxMisses pings in a row go unanswered, the connection is
+// closed and the caller is told why. Create one with NewHeartbeat.
+type Heartbeat struct {
+	// Conn is closed when the peer is declared dead. It may be nil.
+	Conn io.Closer
+
+	// Ping sends one ping. The reading side of the connection must call
+	// Pong whenever the answer arrives.
+	Ping func() error
+
+	// Timeout is how long to wait for a pong after a ping.
+	Timeout time.Duration
+
+	// MaxMisses is how many pings in a row may go unanswered.
+	MaxMisses int
+
+	// OnDead, if set, is called with the reason the connection was given up
+	// on, just after Conn is closed.
+	OnDead func(err error)
+
+	pong chan struct{}
+}
+
+// NewHeartbeat returns a Heartbeat with the default timeout and misses.
+func NewHeartbeat(conn io.Closer, ping func() error) *Heartbeat {
+	return &Heartbeat{
+		Conn:      conn,
+		Ping:      ping,
+		Timeout:   defaultPongTimeout,
+		MaxMisses: defaultMaxMisses,
+		pong:      make(chan struct{}, 1),
+	}
+}
+
+// Pong records that the peer answered. It never blocks.
+func (h *Heartbeat) Pong() {
+	select {
+	case h.pong <- struct{}{}:
+	default:
+	}
+}
+
+// Run pings the peer until ctx is canceled or the peer is declared dead.
+// The ping interval is controlled through reset exactly as it is for
+// Pinger. Run returns ctx.Err() if it was canceled; otherwise it returns
+// an error wrapping ErrHeartbeatTimeout, or the error from a failed ping.
+func (h *Heartbeat) Run(ctx context.Context, reset <-chan time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+
+	sent := make(chan struct{}, 1)
+	pingErr := make(chan error, 1)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		PingerFunc(ctx, func() error {
+			err := h.Ping()
+			if err != nil {
+				pingErr <- err
+				return err
+			}
+
+			select {
+			case sent <- struct{}{}:
+			default:
+			}
+
+			return nil
+		}, reset)
+	}()
+
+	// The pinger has to be gone before Run returns so it can't send pings
+	// on a connection the caller is about to reuse or close.
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var (
+		misses   int
+		timer    *time.Timer
+		deadline <-chan time.Time
+	)
+
+	stopTimer := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+
+		deadline = nil
+	}
+	defer stopTimer()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-pingErr:
+			return h.fail(fmt.Errorf("heartbeat: sending ping: %w", err))
+		case <-sent:
+			// Only the oldest unanswered ping is timed; a pong for any ping
+			// shows the peer is alive.
+			if deadline == nil {
+				timer = time.NewTimer(h.Timeout)
+				deadline = timer.C
+			}
+		case <-h.pong:
+			misses = 0
+			stopTimer()
+		case <-deadline:
+			deadline = nil
+			misses++
+
+			if misses >= h.MaxMisses {
+				return h.fail(fmt.Errorf("%w: %d pings unanswered", ErrHeartbeatTimeout, misses))
+			}
+		}
+	}
+}
+
+func (h *Heartbeat) fail(err error) error {
+	if h.Conn != nil {
+		_ = h.Conn.Close()
+	}
+
+	if h.OnDead != nil {
+		h.OnDead(err)
+	}
+
+	return err
+}
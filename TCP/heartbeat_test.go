@@ -0,0 +1,107 @@
+package ch03
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatPeerAnswers(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+
+	var hb *Heartbeat
+	hb = NewHeartbeat(client, func() error {
+		go hb.Pong() // the peer answers every ping
+		return nil
+	})
+	hb.Timeout = 20 * time.Millisecond
+	hb.MaxMisses = 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	reset := make(chan time.Duration, 1)
+	reset <- 5 * time.Millisecond
+
+	err := hb.Run(ctx, reset)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected heartbeat to run until canceled; actual: %v", err)
+	}
+
+	// The connection is left open for the caller.
+	go func() { _, _ = server.Write([]byte("ok")) }()
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(client, buf)
+	if err != nil {
+		t.Errorf("expected connection to stay open; actual: %v", err)
+	}
+}
+
+func TestHeartbeatDeadPeer(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+
+	var pings int
+	hb := NewHeartbeat(client, func() error {
+		pings++ // nobody answers
+		return nil
+	})
+	hb.Timeout = 20 * time.Millisecond
+	hb.MaxMisses = 3
+
+	var reason error
+	hb.OnDead = func(err error) { reason = err }
+
+	reset := make(chan time.Duration, 1)
+	reset <- 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err := hb.Run(ctx, reset)
+
+	if !errors.Is(err, ErrHeartbeatTimeout) {
+		t.Fatalf("expected ErrHeartbeatTimeout; actual: %v", err)
+	}
+
+	if reason != err {
+		t.Errorf("expected OnDead to get %v; actual: %v", err, reason)
+	}
+
+	if pings < 3 {
+		t.Errorf("expected at least 3 pings; actual: %d", pings)
+	}
+
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("declared dead too early: %s", elapsed)
+	}
+
+	_, err = client.Write([]byte("ping"))
+	if err != io.ErrClosedPipe {
+		t.Errorf("expected connection to be closed; actual: %v", err)
+	}
+}
+
+func TestHeartbeatPingFails(t *testing.T) {
+	client, server := net.Pipe()
+	_ = server.Close()
+
+	hb := NewHeartbeat(client, func() error {
+		_, err := client.Write([]byte("ping"))
+		return err
+	})
+
+	reset := make(chan time.Duration, 1)
+	reset <- time.Millisecond
+
+	err := hb.Run(context.Background(), reset)
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected io.ErrClosedPipe; actual: %v", err)
+	}
+}
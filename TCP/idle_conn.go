@@ -0,0 +1,178 @@
+package ch03
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrIdleTimeout = errors.New("connection closed after idle timeout")
+
+// IdleConn wraps a net.Conn so heartbeats only go out when nothing else is.
+// Every Read and Write pushes the next ping back, the way ping_test.go does
+// by hand, so a ping is only sent after the conn has been idle for the ping
+// interval. If the conn stays idle for the idle timeout, it's closed and
+// Read and Write return ErrIdleTimeout.
+//
+// The pings themselves don't count as activity, but whatever the peer sends
+// back does, so a peer that answers pings keeps the conn open.
+//
+// A ping never goes out in the middle of a Write. Protocols that write a
+// message with several Writes, as Payload.WriteTo does, must write it in one
+// WriteFunc so a ping can't land between the parts.
+type IdleConn struct {
+	net.Conn
+
+	wmu sync.Mutex // held for every write, pings included
+
+	reset    chan time.Duration
+	cancel   context.CancelFunc
+	last     int64 // UnixNano of the last Read or Write, accessed atomically
+	timedOut int32 // set atomically once the idle timeout closed the conn
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewIdleConn pings over conn after it has been idle for idlePing, and
+// closes it after it has been idle for idleTimeout. Either can be zero to
+// turn it off. ping writes a single ping to the conn it's given; if nil, the
+// raw bytes "ping" are written, as Pinger does.
+func NewIdleConn(conn net.Conn, idlePing, idleTimeout time.Duration, ping func(w io.Writer) error) *IdleConn {
+	if ping == nil {
+		ping = func(w io.Writer) error {
+			_, err := w.Write([]byte("ping"))
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &IdleConn{
+		Conn:   conn,
+		reset:  make(chan time.Duration, 1),
+		cancel: cancel,
+		last:   time.Now().UnixNano(),
+	}
+
+	if idlePing > 0 {
+		c.reset <- idlePing
+
+		go PingerFunc(ctx, func() error {
+			c.wmu.Lock()
+			defer c.wmu.Unlock()
+
+			return ping(conn)
+		}, c.reset)
+	}
+
+	if idleTimeout > 0 {
+		go c.watch(ctx, idleTimeout)
+	}
+
+	return c
+}
+
+func (c *IdleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.active()
+	}
+
+	return n, c.err(err)
+}
+
+func (c *IdleConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.write(b)
+}
+
+// WriteFunc calls fn with the conn to itself for writing: nothing else
+// written to the conn, pings included, can come between the writes fn makes
+// to w. For example:
+//
+//	err := conn.WriteFunc(func(w io.Writer) error {
+//		_, err := payload.WriteTo(w)
+//		return err
+//	})
+func (c *IdleConn) WriteFunc(fn func(w io.Writer) error) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return fn(idleWriter{c})
+}
+
+// idleWriter writes to an IdleConn whose write lock is already held.
+type idleWriter struct{ c *IdleConn }
+
+func (w idleWriter) Write(b []byte) (int, error) { return w.c.write(b) }
+
+func (c *IdleConn) write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.active()
+	}
+
+	return n, c.err(err)
+}
+
+// Close stops the heartbeats and closes the underlying conn.
+func (c *IdleConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.closeErr = c.Conn.Close()
+	})
+
+	return c.closeErr
+}
+
+// active records traffic and restarts the ping timer. A reset that's already
+// pending does the same job, so there's no need to block.
+func (c *IdleConn) active() {
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+
+	select {
+	case c.reset <- 0:
+	default:
+	}
+}
+
+// watch closes the conn once it has been idle for timeout. Rather than
+// restarting a timer on every Read and Write, it sleeps until the earliest
+// moment the conn could have timed out and checks again.
+func (c *IdleConn) watch(ctx context.Context, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.last)))
+		if idle >= timeout {
+			atomic.StoreInt32(&c.timedOut, 1)
+			_ = c.Close()
+
+			return
+		}
+
+		timer.Reset(timeout - idle)
+	}
+}
+
+func (c *IdleConn) err(err error) error {
+	if err != nil && atomic.LoadInt32(&c.timedOut) == 1 {
+		return ErrIdleTimeout
+	}
+
+	return err
+}
@@ -0,0 +1,225 @@
+package ch03
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Log(err)
+		}
+
+		accepted <- conn
+	}()
+
+	client, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server = <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+func TestIdleConnPingsOnlyWhenIdle(t *testing.T) {
+	client, server := tcpPair(t)
+
+	conn := NewIdleConn(client, 50*time.Millisecond, 0, nil)
+	defer conn.Close()
+
+	received := make(chan []byte)
+
+	go func() {
+		var buf bytes.Buffer
+		_, _ = io.Copy(&buf, server)
+		received <- buf.Bytes()
+	}()
+
+	// Busy for 200ms, well past the ping interval.
+	for i := 0; i < 20; i++ {
+		_, err := conn.Write([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_ = server.SetReadDeadline(time.Now()) // stops the io.Copy
+
+	if b := <-received; bytes.Contains(b, []byte("ping")) {
+		t.Fatalf("expected no pings while busy; actual: %q", b)
+	}
+
+	// Idle from here on. Anything the io.Copy didn't get to is still data.
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+
+	buf := make([]byte, 4)
+	for {
+		_, err := io.ReadFull(server, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf) == "ping" {
+			break
+		}
+
+		if string(buf) != "data" {
+			t.Fatalf("unexpected bytes: %q", buf)
+		}
+	}
+}
+
+func TestIdleConnTimeout(t *testing.T) {
+	client, server := tcpPair(t)
+
+	conn := NewIdleConn(client, 0, 100*time.Millisecond, nil)
+	defer conn.Close()
+
+	// Traffic from the peer keeps the conn open past the timeout.
+	go func() {
+		for i := 0; i < 15; i++ {
+			_, err := server.Write([]byte("data"))
+			if err != nil {
+				return
+			}
+
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	buf := make([]byte, 4)
+
+	for i := 0; i < 15; i++ {
+		_, err := io.ReadFull(conn, buf)
+		if err != nil {
+			t.Fatalf("read %d after %s: %v", i, time.Since(start), err)
+		}
+	}
+
+	// Then the peer goes quiet.
+	_, err := conn.Read(buf)
+	if err != ErrIdleTimeout {
+		t.Fatalf("expected ErrIdleTimeout; actual: %v", err)
+	}
+
+	_, err = conn.Write([]byte("data"))
+	if err != ErrIdleTimeout {
+		t.Errorf("expected ErrIdleTimeout from Write; actual: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 380*time.Millisecond {
+		t.Errorf("closed too early: %s", elapsed)
+	}
+}
+
+func TestIdleConnAnsweredPingsKeepItOpen(t *testing.T) {
+	client, server := tcpPair(t)
+
+	conn := NewIdleConn(client, 20*time.Millisecond, 100*time.Millisecond, nil)
+	defer conn.Close()
+
+	// The peer answers every ping.
+	go func() {
+		buf := make([]byte, 4)
+		for {
+			_, err := io.ReadFull(server, buf)
+			if err != nil {
+				return
+			}
+
+			_, err = server.Write([]byte("pong"))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 4)
+	deadline := time.Now().Add(300 * time.Millisecond)
+
+	for time.Now().Before(deadline) {
+		_, err := io.ReadFull(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Close stops the pinger and is safe to repeat.
+	err := conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.Close()
+}
+
+func TestIdleConnWriteFuncKeepsPingsOut(t *testing.T) {
+	client, server := tcpPair(t)
+
+	conn := NewIdleConn(client, 20*time.Millisecond, 0, nil)
+	defer conn.Close()
+
+	received := make(chan []byte)
+
+	go func() {
+		var buf bytes.Buffer
+		_, _ = io.Copy(&buf, server)
+		received <- buf.Bytes()
+	}()
+
+	// The pinger comes due between the two halves of the message.
+	err := conn.WriteFunc(func(w io.Writer) error {
+		if _, err := w.Write([]byte("hel")); err != nil {
+			return err
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		_, err := w.Write([]byte("lo"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	_ = conn.Close()
+
+	actual := <-received
+	if !bytes.HasPrefix(actual, []byte("hello")) {
+		t.Errorf("expected the message before any ping; actual: %q", actual)
+	}
+
+	if !bytes.Contains(actual[5:], []byte("ping")) {
+		t.Errorf("expected a ping after the message; actual: %q", actual)
+	}
+}
@@ -8,7 +8,20 @@ import (
 
 const defaultPingInterval = 30 * time.Second
 
+// Pinger writes "ping" to w every interval until ctx is canceled or a write
+// fails. Sending an interval on reset restarts the timer with it; sending
+// zero restarts the timer with the current interval, e.g. after hearing from
+// the peer.
 func Pinger(ctx context.Context, w io.Writer, reset <-chan time.Duration) {
+	PingerFunc(ctx, func() error {
+		_, err := w.Write([]byte("ping"))
+		return err
+	}, reset)
+}
+
+// PingerFunc is Pinger for protocols where a ping is more than a raw write.
+// It calls ping on every tick and stops when it returns an error.
+func PingerFunc(ctx context.Context, ping func() error, reset <-chan time.Duration) {
 	var interval time.Duration
 
 	select {
@@ -25,8 +38,13 @@ func Pinger(ctx context.Context, w io.Writer, reset <-chan time.Duration) {
 	timer := time.NewTimer(interval)
 
 	defer func() {
+		// The timer has already fired and been drained if ping just failed,
+		// so don't wait for another value.
 		if !timer.Stop() {
-			<-timer.C
+			select {
+			case <-timer.C:
+			default:
+			}
 		}
 	}()
 
@@ -43,7 +61,7 @@ func Pinger(ctx context.Context, w io.Writer, reset <-chan time.Duration) {
 				interval = newInterval
 			}
 		case <-timer.C:
-			if _, err := w.Write([]byte("ping")); err != nil {
+			if err := ping(); err != nil {
 				return
 			}
 		}
@@ -101,3 +101,37 @@ func TestPingerAdvancedDeadline(t *testing.T) {
 		t.Fatalf("Expected EOF at 9 seconds, actual %s", end)
 	}
 }
+
+func TestPingerFunc(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reset := make(chan time.Duration, 1)
+	reset <- 10 * time.Millisecond
+
+	pings := make(chan time.Time, 10)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		PingerFunc(ctx, func() error {
+			pings <- time.Now()
+			if len(pings) == 3 {
+				return io.ErrClosedPipe // stops the pinger
+			}
+
+			return nil
+		}, reset)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pinger didn't stop after ping failed")
+	}
+
+	if len(pings) != 3 {
+		t.Errorf("expected 3 pings; actual: %d", len(pings))
+	}
+}
@@ -0,0 +1,373 @@
+package ch03
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxIdle     = 2
+	defaultIdleTimeout = 90 * time.Second
+)
+
+var (
+	ErrPoolClosed     = errors.New("pool: closed")
+	ErrUnexpectedData = errors.New("pool: idle connection has unread data")
+)
+
+// PoolConfig configures a Pool. The limits apply to each address separately.
+type PoolConfig struct {
+	// MaxIdle is how many idle connections are kept. Defaults to 2.
+	MaxIdle int
+
+	// MaxActive caps the connections checked out at once. Get waits for one
+	// to be returned once the cap is reached. Zero means no cap.
+	MaxActive int
+
+	// IdleTimeout is how long a connection may sit idle before it's closed
+	// instead of reused. Defaults to 90 seconds.
+	IdleTimeout time.Duration
+
+	// Dial defaults to DialContext.
+	Dial DialFunc
+
+	// HealthCheck vets an idle connection before it's handed out. It
+	// defaults to ProbeConn; it could also, say, send a heartbeat.
+	HealthCheck func(net.Conn) error
+}
+
+// PoolStats is a snapshot of a Pool's counters.
+type PoolStats struct {
+	Hits      int64 // Gets served by an idle connection
+	Misses    int64 // Gets that had to dial
+	Waits     int64 // Gets that had to wait because MaxActive was reached
+	Evictions int64 // idle connections closed for being stale or unhealthy
+
+	Idle   int // connections idle right now
+	Active int // connections checked out or being dialed right now
+}
+
+// Pool keeps idle TCP connections around for reuse, keyed by address.
+// Connections are reused last-in first-out so the least recently used ones
+// are the ones left to time out. Stale connections are closed whenever the
+// pool is used, whichever address they belong to, and addresses left with
+// nothing idle or checked out are forgotten.
+type Pool struct {
+	cfg PoolConfig
+
+	mu     sync.Mutex
+	hosts  map[string]*poolHost
+	stats  PoolStats
+	closed bool
+}
+
+type poolHost struct {
+	idle    []idleConn
+	active  int
+	waiters []chan struct{}
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+func NewPool(cfg PoolConfig) *Pool {
+	if cfg.MaxIdle <= 0 {
+		cfg.MaxIdle = defaultMaxIdle
+	}
+
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = defaultIdleTimeout
+	}
+
+	if cfg.Dial == nil {
+		cfg.Dial = DialContext
+	}
+
+	if cfg.HealthCheck == nil {
+		cfg.HealthCheck = ProbeConn
+	}
+
+	return &Pool{cfg: cfg, hosts: make(map[string]*poolHost)}
+}
+
+// Get returns a connection to address, reusing an idle one if a healthy one
+// is available. If MaxActive connections are already out, it waits until
+// one is returned or ctx is done.
+func (p *Pool) Get(ctx context.Context, address string) (*PooledConn, error) {
+	for {
+		p.mu.Lock()
+
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		p.sweep()
+		h := p.host(address)
+
+		if conn := p.popIdle(h); conn != nil {
+			h.active++
+			p.mu.Unlock()
+
+			if err := p.cfg.HealthCheck(conn); err != nil {
+				_ = conn.Close()
+				p.release(address, true)
+
+				continue
+			}
+
+			p.mu.Lock()
+			p.stats.Hits++
+			p.mu.Unlock()
+
+			return &PooledConn{Conn: conn, pool: p, address: address}, nil
+		}
+
+		if p.cfg.MaxActive <= 0 || h.active < p.cfg.MaxActive {
+			h.active++
+			p.stats.Misses++
+			p.mu.Unlock()
+
+			conn, err := p.cfg.Dial(ctx, "tcp", address)
+			if err != nil {
+				p.release(address, false)
+				return nil, err
+			}
+
+			return &PooledConn{Conn: conn, pool: p, address: address}, nil
+		}
+
+		wait := make(chan struct{}, 1)
+		h.waiters = append(h.waiters, wait)
+		p.stats.Waits++
+		p.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			p.abandon(h, wait)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Stats returns the pool's counters.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sweep()
+	stats := p.stats
+
+	for _, h := range p.hosts {
+		stats.Idle += len(h.idle)
+		stats.Active += h.active
+	}
+
+	return stats
+}
+
+// Close closes the idle connections. Connections checked out are closed
+// when they're returned, and later Gets fail with ErrPoolClosed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+
+	p.closed = true
+
+	for _, h := range p.hosts {
+		for _, ic := range h.idle {
+			_ = ic.conn.Close()
+		}
+
+		h.idle = nil
+
+		for _, w := range h.waiters {
+			w <- struct{}{} // they'll see the pool is closed
+		}
+
+		h.waiters = nil
+	}
+
+	return nil
+}
+
+func (p *Pool) host(address string) *poolHost {
+	h, ok := p.hosts[address]
+	if !ok {
+		h = new(poolHost)
+		p.hosts[address] = h
+	}
+
+	return h
+}
+
+// sweep closes the idle connections that have timed out, across all
+// addresses, and drops the addresses no longer in use. The caller holds p.mu.
+func (p *Pool) sweep() {
+	for address, h := range p.hosts {
+		// The oldest connections are at the front.
+		n := 0
+		for n < len(h.idle) && time.Since(h.idle[n].since) >= p.cfg.IdleTimeout {
+			_ = h.idle[n].conn.Close()
+			p.stats.Evictions++
+			n++
+		}
+
+		if n > 0 {
+			h.idle = append(h.idle[:0], h.idle[n:]...)
+		}
+
+		if len(h.idle) == 0 && h.active == 0 && len(h.waiters) == 0 {
+			delete(p.hosts, address)
+		}
+	}
+}
+
+// popIdle returns the most recently used idle connection that hasn't timed
+// out, closing any that have. The caller holds p.mu.
+func (p *Pool) popIdle(h *poolHost) net.Conn {
+	for len(h.idle) > 0 {
+		ic := h.idle[len(h.idle)-1]
+		h.idle = h.idle[:len(h.idle)-1]
+
+		if time.Since(ic.since) < p.cfg.IdleTimeout {
+			return ic.conn
+		}
+
+		_ = ic.conn.Close()
+		p.stats.Evictions++
+	}
+
+	return nil
+}
+
+// put takes back a checked-out connection, keeping it if there's room.
+func (p *Pool) put(address string, conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sweep()
+	h := p.host(address)
+	h.active--
+
+	if p.closed || len(h.idle) >= p.cfg.MaxIdle {
+		_ = conn.Close()
+	} else {
+		h.idle = append(h.idle, idleConn{conn: conn, since: time.Now()})
+	}
+
+	p.wake(h)
+}
+
+// release frees the slot of a connection that won't be coming back, e.g.
+// because it failed its health check or its dial failed.
+func (p *Pool) release(address string, evicted bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := p.host(address)
+	h.active--
+
+	if evicted {
+		p.stats.Evictions++
+	}
+
+	p.wake(h)
+	p.sweep()
+}
+
+// wake lets the longest waiting Get try again. The caller holds p.mu.
+func (p *Pool) wake(h *poolHost) {
+	if len(h.waiters) == 0 {
+		return
+	}
+
+	h.waiters[0] <- struct{}{}
+	h.waiters = h.waiters[1:]
+}
+
+// abandon removes a waiter whose context is done. If it was woken in the
+// meantime, the wake-up is passed on so it isn't lost.
+func (p *Pool) abandon(h *poolHost, wait chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, w := range h.waiters {
+		if w == wait {
+			h.waiters = append(h.waiters[:i], h.waiters[i+1:]...)
+			return
+		}
+	}
+
+	p.wake(h)
+}
+
+// PooledConn is a connection checked out of a Pool. Close hands it back for
+// reuse; a connection that's in an unknown state, e.g. after an error or a
+// half-read response, must be given up with Discard instead.
+type PooledConn struct {
+	net.Conn
+
+	pool    *Pool
+	address string
+	once    sync.Once
+}
+
+// Close returns the connection to the pool.
+func (c *PooledConn) Close() error {
+	c.once.Do(func() { c.pool.put(c.address, c.Conn) })
+	return nil
+}
+
+// Discard closes the connection for good. It does nothing if the connection
+// was already returned.
+func (c *PooledConn) Discard() error {
+	var err error
+
+	c.once.Do(func() {
+		err = c.Conn.Close()
+		c.pool.release(c.address, false)
+	})
+
+	return err
+}
+
+// probeWindow is how long the portable probe waits for a read to fail.
+const probeWindow = time.Millisecond
+
+// probeRead checks conn by reading with a deadline just ahead: a closed
+// connection reports EOF or an error straight away, a healthy one times out.
+// It costs probeWindow per check, so ProbeConn peeks at the socket instead
+// where it can.
+func probeRead(conn net.Conn) error {
+	err := conn.SetReadDeadline(time.Now().Add(probeWindow))
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	var b [1]byte
+
+	n, err := conn.Read(b[:])
+
+	switch {
+	case n > 0:
+		return ErrUnexpectedData
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return nil
+	default:
+		return err
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package ch03
+
+import "net"
+
+// ProbeConn checks that an idle connection is still usable before it's
+// reused. A zero-byte Read can't tell: Go returns from it without touching
+// the socket. Instead it reads with a deadline a moment away: EOF or an
+// error means the peer has gone, data means the peer sent something nobody
+// asked for, and a timeout means the connection is healthy.
+func ProbeConn(conn net.Conn) error {
+	return probeRead(conn)
+}
@@ -0,0 +1,54 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package ch03
+
+import (
+	"io"
+	"net"
+	"syscall"
+)
+
+// ProbeConn checks that an idle connection is still usable before it's
+// reused. A zero-byte Read can't tell: Go returns from it without touching
+// the socket. Instead it peeks at the socket without blocking: nothing to
+// read means healthy, EOF or an error means the peer has gone, and data
+// means the peer sent something nobody asked for, so the connection is out
+// of step. Connections that don't expose their socket, such as TLS ones,
+// get a short read probe instead.
+func ProbeConn(conn net.Conn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return probeRead(conn)
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var (
+		b    [1]byte
+		n    int
+		rErr error
+	)
+
+	err = rc.Read(func(fd uintptr) bool {
+		n, _, rErr = syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		return true // never wait for the socket to become readable
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case rErr == syscall.EAGAIN || rErr == syscall.EWOULDBLOCK:
+		return nil
+	case rErr != nil:
+		return rErr
+	case n == 0:
+		return io.EOF
+	default:
+		return ErrUnexpectedData
+	}
+}
@@ -0,0 +1,377 @@
+package ch03
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// poolServer listens on loopback and hands over every connection it accepts.
+func poolServer(t *testing.T) (string, <-chan net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn, 16)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			accepted <- conn
+		}
+	}()
+
+	t.Cleanup(func() {
+		listener.Close()
+
+		for {
+			select {
+			case conn := <-accepted:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+
+	return listener.Addr().String(), accepted
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	addr, _ := poolServer(t)
+
+	pool := NewPool(PoolConfig{})
+	defer pool.Close()
+
+	ctx := context.Background()
+
+	first, err := pool.Get(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := first.LocalAddr().String()
+	_ = first.Close()
+	_ = first.Close() // returning it twice mustn't pool it twice
+
+	second, err := pool.Get(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if actual := second.LocalAddr().String(); actual != local {
+		t.Errorf("expected the connection from %s to be reused; actual: %s", local, actual)
+	}
+
+	stats := pool.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Active != 1 || stats.Idle != 0 {
+		t.Errorf("expected 1 hit, 1 miss and 1 active; actual: %+v", stats)
+	}
+}
+
+func TestPoolEvictsUnhealthyConnections(t *testing.T) {
+	addr, accepted := poolServer(t)
+
+	pool := NewPool(PoolConfig{})
+	defer pool.Close()
+
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		name      string
+		breakConn func(server net.Conn)
+	}{
+		{"peer closed", func(server net.Conn) { _ = server.Close() }},
+		{"unsolicited data", func(server net.Conn) { _, _ = server.Write([]byte("surprise")) }},
+	} {
+		conn, err := pool.Get(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		local := conn.LocalAddr().String()
+		_ = conn.Close()
+
+		test.breakConn(<-accepted)
+		time.Sleep(50 * time.Millisecond) // let it reach the client
+
+		before := pool.Stats().Evictions
+
+		conn, err = pool.Get(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if conn.LocalAddr().String() == local {
+			t.Errorf("%s: expected a new connection", test.name)
+		}
+
+		if evictions := pool.Stats().Evictions - before; evictions != 1 {
+			t.Errorf("%s: expected 1 eviction; actual: %d", test.name, evictions)
+		}
+
+		_ = conn.Discard()
+		_ = (<-accepted).Close()
+	}
+}
+
+func TestPoolIdleLimits(t *testing.T) {
+	addr, _ := poolServer(t)
+
+	pool := NewPool(PoolConfig{MaxIdle: 1, IdleTimeout: 50 * time.Millisecond})
+	defer pool.Close()
+
+	ctx := context.Background()
+
+	a, err := pool.Get(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := pool.Get(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = a.Close()
+	_ = b.Close()
+
+	// The second one didn't fit and was closed.
+	if _, err := b.Conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection past MaxIdle to be closed")
+	}
+
+	if stats := pool.Stats(); stats.Idle != 1 {
+		t.Errorf("expected 1 idle connection; actual: %d", stats.Idle)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := pool.Get(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	stats := pool.Stats()
+	if stats.Hits != 0 || stats.Misses != 3 || stats.Evictions != 1 {
+		t.Errorf("expected the stale connection to be evicted; actual: %+v", stats)
+	}
+}
+
+func TestPoolWaitsWhenExhausted(t *testing.T) {
+	addr, _ := poolServer(t)
+
+	pool := NewPool(PoolConfig{MaxActive: 1})
+	defer pool.Close()
+
+	first, err := pool.Get(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = pool.Get(ctx, addr)
+	cancel()
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the wait to time out; actual: %v", err)
+	}
+
+	got := make(chan *PooledConn)
+
+	go func() {
+		conn, err := pool.Get(context.Background(), addr)
+		if err != nil {
+			t.Error(err)
+		}
+
+		got <- conn
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("expected Get to wait for a connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	local := first.LocalAddr().String()
+	_ = first.Close()
+
+	second := <-got
+	if second == nil {
+		t.FailNow()
+	}
+	defer second.Close()
+
+	if actual := second.LocalAddr().String(); actual != local {
+		t.Errorf("expected the returned connection %s; actual: %s", local, actual)
+	}
+
+	if stats := pool.Stats(); stats.Waits != 2 || stats.Active != 1 {
+		t.Errorf("expected 2 waits and 1 active; actual: %+v", stats)
+	}
+}
+
+func TestPoolDiscardFreesSlot(t *testing.T) {
+	addr, _ := poolServer(t)
+
+	pool := NewPool(PoolConfig{MaxActive: 1})
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	conn, err := pool.Get(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Discard(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err = pool.Get(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if stats := pool.Stats(); stats.Misses != 2 || stats.Idle != 0 {
+		t.Errorf("expected the discarded connection to be dropped; actual: %+v", stats)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	addr, _ := poolServer(t)
+
+	pool := NewPool(PoolConfig{MaxActive: 1})
+
+	ctx := context.Background()
+
+	conn, err := pool.Get(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waiting := make(chan error)
+
+	go func() {
+		_, err := pool.Get(ctx, addr)
+		waiting <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	_ = pool.Close()
+
+	if err := <-waiting; err != ErrPoolClosed {
+		t.Errorf("expected waiting Get to fail with ErrPoolClosed; actual: %v", err)
+	}
+
+	_ = conn.Close()
+
+	if _, err := conn.Conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected connection returned to a closed pool to be closed")
+	}
+
+	if _, err := pool.Get(ctx, addr); err != ErrPoolClosed {
+		t.Errorf("expected ErrPoolClosed; actual: %v", err)
+	}
+}
+
+func TestProbeConn(t *testing.T) {
+	for name, probe := range map[string]func(net.Conn) error{
+		"ProbeConn": ProbeConn,
+		"probeRead": probeRead,
+	} {
+		client, server := tcpPair(t)
+
+		if err := probe(client); err != nil {
+			t.Errorf("%s: expected a healthy connection; actual: %v", name, err)
+		}
+
+		_, _ = server.Write([]byte("x"))
+		time.Sleep(20 * time.Millisecond)
+
+		if err := probe(client); err != ErrUnexpectedData {
+			t.Errorf("%s: expected ErrUnexpectedData; actual: %v", name, err)
+		}
+
+		client, server = tcpPair(t)
+		_ = server.Close()
+		time.Sleep(20 * time.Millisecond)
+
+		if err := probe(client); err != io.EOF {
+			t.Errorf("%s: expected io.EOF; actual: %v", name, err)
+		}
+
+		// A healthy probe leaves the connection as it found it.
+		client, server = tcpPair(t)
+		_ = probe(client)
+		_, _ = server.Write([]byte("y"))
+
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(client, b); err != nil || b[0] != 'y' {
+			t.Errorf("%s: expected to read y; actual: %q, %v", name, b, err)
+		}
+	}
+}
+
+func TestPoolSweepsAllAddresses(t *testing.T) {
+	addrA, _ := poolServer(t)
+	addrB, _ := poolServer(t)
+
+	pool := NewPool(PoolConfig{IdleTimeout: 50 * time.Millisecond})
+	defer pool.Close()
+
+	ctx := context.Background()
+
+	a, err := pool.Get(ctx, addrA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = a.Close()
+
+	if stats := pool.Stats(); stats.Idle != 1 {
+		t.Errorf("expected 1 idle connection; actual: %d", stats.Idle)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Expired connections aren't counted, even before anything is reused.
+	if stats := pool.Stats(); stats.Idle != 0 || stats.Evictions != 1 {
+		t.Errorf("expected the stale connection to be evicted; actual: %+v", stats)
+	}
+
+	if _, err := a.Conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the stale connection to be closed")
+	}
+
+	// Using another address sweeps too, and forgets the unused one.
+	b, err := pool.Get(ctx, addrB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = b.Close()
+
+	pool.mu.Lock()
+	_, ok := pool.hosts[addrA]
+	pool.mu.Unlock()
+
+	if ok {
+		t.Errorf("expected %s to be forgotten", addrA)
+	}
+}
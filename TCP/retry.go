@@ -0,0 +1,381 @@
+package ch03
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMaxAttempts = 5
+	defaultBaseDelay   = 100 * time.Millisecond
+	defaultMaxDelay    = 5 * time.Second
+
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+var ErrCircuitOpen = errors.New("dial: circuit open")
+
+// ErrorClass is the kind of failure a dial ran into.
+type ErrorClass int
+
+const (
+	ClassOther ErrorClass = iota
+	ClassRefused
+	ClassTimeout
+	ClassUnreachable
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassRefused:
+		return "refused"
+	case ClassTimeout:
+		return "timeout"
+	case ClassUnreachable:
+		return "unreachable"
+	default:
+		return "other"
+	}
+}
+
+// ClassifyDialError works out why a dial failed. A dial that ran out of time
+// is ClassTimeout however its deadline was set, since net reports a connect
+// timeout as context.DeadlineExceeded too. Whether it was the caller's own
+// context expiring, which says nothing about the destination, can only be
+// told by asking that context.
+func ClassifyDialError(err error) ErrorClass {
+	var nErr net.Error
+
+	switch {
+	case err == nil:
+		return ClassOther
+	case errors.Is(err, context.Canceled):
+		return ClassOther
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ClassRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return ClassUnreachable
+	case errors.As(err, &nErr) && nErr.Timeout():
+		return ClassTimeout
+	default:
+		return ClassOther
+	}
+}
+
+// RetryDialer retries failed dials with capped exponential backoff and full
+// jitter: before retry n it sleeps for a random time between zero and
+// BaseDelay*2^n, but never more than MaxDelay. The jitter stops clients that
+// failed together from all retrying together.
+//
+// Only refused, timed out and unreachable dials are retried; anything else,
+// e.g. an unknown host, won't get better by trying again. A dial also isn't
+// retried if ctx would expire before the backoff ends.
+type RetryDialer struct {
+	// Dial defaults to DialContext, so a DialTrace in the context sees
+	// every attempt.
+	Dial DialFunc
+
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts int
+
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Breaker, if set, is told the result of every attempt, and dials to a
+	// destination it has given up on fail with ErrCircuitOpen.
+	Breaker *CircuitBreaker
+
+	// jitter returns a random duration in [0, d). Tests replace it.
+	jitter func(d time.Duration) time.Duration
+}
+
+// NewRetryDialer returns a RetryDialer with the default limits.
+func NewRetryDialer() *RetryDialer {
+	return &RetryDialer{
+		MaxAttempts: defaultMaxAttempts,
+		BaseDelay:   defaultBaseDelay,
+		MaxDelay:    defaultMaxDelay,
+	}
+}
+
+func (d *RetryDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dial := d.Dial
+	if dial == nil {
+		dial = DialContext
+	}
+
+	maxAttempts := d.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var lastErr error
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			err := d.backoff(ctx, attempt)
+			if err != nil {
+				return nil, fmt.Errorf("dial %s: giving up after %d attempts: %w", address, attempt, lastErr)
+			}
+		}
+
+		if d.Breaker != nil {
+			err := d.Breaker.Allow(address)
+			if err != nil {
+				return nil, fmt.Errorf("dial %s: %w", address, err)
+			}
+		}
+
+		conn, err := dial(ctx, network, address)
+
+		// The caller giving up isn't the destination's fault, and there's
+		// no time left to retry anyway.
+		class := ClassifyDialError(err)
+		if err != nil && ctx.Err() != nil {
+			class = ClassOther
+		}
+
+		if d.Breaker != nil {
+			switch {
+			case err == nil:
+				d.Breaker.Success(address)
+			case class != ClassOther:
+				d.Breaker.Failure(address)
+			default:
+				// A half-open probe still has to be given back.
+				d.Breaker.Cancel(address)
+			}
+		}
+
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+
+		if class == ClassOther {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("dial %s: giving up after %d attempts: %w", address, maxAttempts, lastErr)
+}
+
+// backoff sleeps before the given retry. It returns an error straight away
+// if ctx would be done before the sleep is over.
+func (d *RetryDialer) backoff(ctx context.Context, attempt int) error {
+	ceiling := d.MaxDelay
+	if shift := attempt - 1; shift < 32 && d.BaseDelay<<shift > 0 && d.BaseDelay<<shift < ceiling {
+		ceiling = d.BaseDelay << shift
+	}
+
+	jitter := d.jitter
+	if jitter == nil {
+		jitter = randomJitter
+	}
+
+	delay := jitter(ceiling)
+
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+		return context.DeadlineExceeded
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// jitterRand is seeded here since the global source isn't seeded before
+// Go 1.20, which would have every process back off in lockstep. A *rand.Rand
+// isn't safe for concurrent use, hence the mutex.
+var jitterRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func randomJitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	jitterRand.Lock()
+	defer jitterRand.Unlock()
+
+	return time.Duration(jitterRand.Int63n(int64(d)))
+}
+
+// BreakerState is the state of one destination's circuit.
+type BreakerState int
+
+const (
+	// BreakerClosed lets dials through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails dials without trying.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe through to see if the
+	// destination has recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker tracks failures per destination. After Threshold failures
+// in a row the destination's circuit opens and dials to it fail fast for
+// Cooldown. After that, one probe dial is let through: if it succeeds the
+// circuit closes again, if not it stays open for another Cooldown.
+//
+// The zero value is ready to use. A Threshold or Cooldown of zero means the
+// same defaults NewCircuitBreaker uses.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+	now      func() time.Time
+}
+
+type circuit struct {
+	failures int
+	openedAt time.Time
+	open     bool
+	probing  bool
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+func (b *CircuitBreaker) threshold() int {
+	if b.Threshold <= 0 {
+		return defaultBreakerThreshold
+	}
+
+	return b.Threshold
+}
+
+func (b *CircuitBreaker) cooldown() time.Duration {
+	if b.Cooldown <= 0 {
+		return defaultBreakerCooldown
+	}
+
+	return b.Cooldown
+}
+
+func (b *CircuitBreaker) clock() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+
+	return b.now()
+}
+
+// Allow reports whether a dial to address may go ahead. Every allowed dial
+// must be followed by Success, Failure or Cancel.
+func (b *CircuitBreaker) Allow(address string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[address]
+	if !ok || !c.open {
+		return nil
+	}
+
+	if c.probing || b.clock().Sub(c.openedAt) < b.cooldown() {
+		return ErrCircuitOpen
+	}
+
+	c.probing = true
+
+	return nil
+}
+
+// Success closes address's circuit.
+func (b *CircuitBreaker) Success(address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.circuits, address)
+}
+
+// Failure counts a failed dial, opening the circuit once there are enough
+// of them or if the dial was the half-open probe.
+func (b *CircuitBreaker) Failure(address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.circuits == nil {
+		b.circuits = make(map[string]*circuit)
+	}
+
+	c, ok := b.circuits[address]
+	if !ok {
+		c = new(circuit)
+		b.circuits[address] = c
+	}
+
+	c.failures++
+
+	if c.probing || c.failures >= b.threshold() {
+		c.open = true
+		c.probing = false
+		c.openedAt = b.clock()
+	}
+}
+
+// Cancel gives back an allowed dial that says nothing about the
+// destination's health, e.g. because the caller gave up on it.
+func (b *CircuitBreaker) Cancel(address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c, ok := b.circuits[address]; ok {
+		c.probing = false
+	}
+}
+
+// State returns address's circuit state.
+func (b *CircuitBreaker) State(address string) BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[address]
+	switch {
+	case !ok || !c.open:
+		return BreakerClosed
+	case c.probing || b.clock().Sub(c.openedAt) >= b.cooldown():
+		return BreakerHalfOpen
+	default:
+		return BreakerOpen
+	}
+}
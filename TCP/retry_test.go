@@ -0,0 +1,342 @@
+package ch03
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// refusedAddress returns an address nothing is listening on.
+func refusedAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := listener.Addr().String()
+	listener.Close()
+
+	return addr
+}
+
+func TestClassifyDialError(t *testing.T) {
+	var d net.Dialer
+
+	_, err := d.Dial("tcp", refusedAddress(t))
+	if class := ClassifyDialError(err); class != ClassRefused {
+		t.Errorf("expected refused; actual: %s (%v)", class, err)
+	}
+
+	for err, expected := range map[error]ErrorClass{
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}: ClassUnreachable,
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}:  ClassUnreachable,
+		&net.DNSError{Err: "i/o timeout", IsTimeout: true}:                                 ClassTimeout,
+		&net.DNSError{Err: "no such host", IsNotFound: true}:                               ClassOther,
+		&net.OpError{Op: "dial", Err: context.Canceled}:                                    ClassOther,
+	} {
+		if class := ClassifyDialError(err); class != expected {
+			t.Errorf("%v: expected %s; actual: %s", err, expected, class)
+		}
+	}
+}
+
+// slowConnect returns a dialer whose connect can't start until after its
+// Timeout has passed, so every dial times out for real.
+func slowConnect(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(string, string, syscall.RawConn) error {
+			time.Sleep(2 * timeout)
+			return nil
+		},
+	}
+}
+
+func TestClassifyDialTimeout(t *testing.T) {
+	_, err := slowConnect(10*time.Millisecond).Dial("tcp", refusedAddress(t))
+	if class := ClassifyDialError(err); class != ClassTimeout {
+		t.Errorf("expected timeout; actual: %s (%v)", class, err)
+	}
+}
+
+func TestRetryDialerRetriesTimeouts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	calls := 0
+
+	d := NewRetryDialer()
+	d.jitter = func(time.Duration) time.Duration { return 0 }
+	d.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		calls++
+		if calls <= 2 {
+			return slowConnect(10*time.Millisecond).DialContext(ctx, network, address)
+		}
+
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+
+	conn, err := d.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("expected timed out attempts to be retried; actual: %v", err)
+	}
+	conn.Close()
+
+	if calls != 3 {
+		t.Errorf("expected 3 attempts; actual: %d", calls)
+	}
+
+	// When it's the caller's own deadline that passes, there's no retry.
+	calls = 0
+	d.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		calls++
+		return slowConnect(100*time.Millisecond).DialContext(ctx, network, address)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = d.DialContext(ctx, "tcp", listener.Addr().String())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to pass; actual: %v", err)
+	}
+
+	if calls != 1 {
+		t.Errorf("expected 1 attempt; actual: %d", calls)
+	}
+}
+
+// scriptedDial fails with each of errs in turn, then connects to addr.
+func scriptedDial(addr string, errs ...error) (DialFunc, *int) {
+	calls := new(int)
+
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		*calls++
+		if *calls <= len(errs) {
+			return nil, errs[*calls-1]
+		}
+
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}, calls
+}
+
+var errRefused = &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+func TestRetryDialerRecovers(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	dial, calls := scriptedDial(listener.Addr().String(), errRefused, errRefused)
+
+	var ceilings []time.Duration
+
+	d := NewRetryDialer()
+	d.Dial = dial
+	d.BaseDelay = 10 * time.Millisecond
+	d.MaxDelay = 15 * time.Millisecond
+	d.jitter = func(ceiling time.Duration) time.Duration {
+		ceilings = append(ceilings, ceiling)
+		return 0
+	}
+
+	conn, err := d.DialContext(context.Background(), "tcp", "backend:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if *calls != 3 {
+		t.Errorf("expected 3 attempts; actual: %d", *calls)
+	}
+
+	// The backoff doubles, up to MaxDelay.
+	expected := []time.Duration{10 * time.Millisecond, 15 * time.Millisecond}
+	if len(ceilings) != len(expected) || ceilings[0] != expected[0] || ceilings[1] != expected[1] {
+		t.Errorf("expected backoff ceilings %v; actual: %v", expected, ceilings)
+	}
+}
+
+func TestRetryDialerGivesUp(t *testing.T) {
+	d := NewRetryDialer()
+	d.MaxAttempts = 3
+	d.BaseDelay = time.Millisecond
+
+	start := time.Now()
+
+	_, err := d.DialContext(context.Background(), "tcp", refusedAddress(t))
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected connection refused; actual: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retries took too long: %s", elapsed)
+	}
+}
+
+func TestRetryDialerDoesntRetryOtherErrors(t *testing.T) {
+	notFound := &net.DNSError{Err: "no such host", Name: "backend", IsNotFound: true}
+	dial, calls := scriptedDial("", notFound)
+
+	d := NewRetryDialer()
+	d.Dial = dial
+
+	_, err := d.DialContext(context.Background(), "tcp", "backend:7")
+	if err != notFound {
+		t.Errorf("expected the DNS error; actual: %v", err)
+	}
+
+	if *calls != 1 {
+		t.Errorf("expected 1 attempt; actual: %d", *calls)
+	}
+}
+
+func TestRetryDialerRespectsDeadline(t *testing.T) {
+	dial, calls := scriptedDial("", errRefused, errRefused, errRefused)
+
+	d := NewRetryDialer()
+	d.Dial = dial
+	d.BaseDelay = time.Second
+	d.jitter = func(ceiling time.Duration) time.Duration { return ceiling }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err := d.DialContext(ctx, "tcp", "backend:7")
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("expected the last dial error; actual: %v", err)
+	}
+
+	// The backoff would outlast the deadline, so there's no point waiting.
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected to give up at once; took %s", elapsed)
+	}
+
+	if *calls != 1 {
+		t.Errorf("expected 1 attempt; actual: %d", *calls)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+
+	b := NewCircuitBreaker(3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	dial, calls := scriptedDial("", errRefused, errRefused, errRefused, errRefused, errRefused)
+
+	d := NewRetryDialer()
+	d.Dial = dial
+	d.MaxAttempts = 10
+	d.Breaker = b
+	d.jitter = func(time.Duration) time.Duration { return 0 }
+
+	_, err := d.DialContext(context.Background(), "tcp", "backend:7")
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen; actual: %v", err)
+	}
+
+	if *calls != 3 {
+		t.Errorf("expected the circuit to open after 3 failures; actual: %d attempts", *calls)
+	}
+
+	if s := b.State("backend:7"); s != BreakerOpen {
+		t.Errorf("expected open; actual: %s", s)
+	}
+
+	// Other destinations aren't affected.
+	if err := b.Allow("other:7"); err != nil {
+		t.Errorf("expected other destination to be allowed; actual: %v", err)
+	}
+
+	// After the cooldown a single probe is let through; it fails, so the
+	// circuit opens again.
+	now = now.Add(time.Minute)
+
+	if s := b.State("backend:7"); s != BreakerHalfOpen {
+		t.Errorf("expected half-open; actual: %s", s)
+	}
+
+	d.MaxAttempts = 1
+
+	_, err = d.DialContext(context.Background(), "tcp", "backend:7")
+	if !errors.Is(err, syscall.ECONNREFUSED) || *calls != 4 {
+		t.Fatalf("expected one failed probe; actual: %v after %d attempts", err, *calls)
+	}
+
+	_, err = d.DialContext(context.Background(), "tcp", "backend:7")
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen after failed probe; actual: %v", err)
+	}
+
+	// The next probe succeeds and closes the circuit.
+	now = now.Add(time.Minute)
+
+	err = b.Allow("backend:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Allow("backend:7"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected only one probe at a time; actual: %v", err)
+	}
+
+	b.Success("backend:7")
+
+	if s := b.State("backend:7"); s != BreakerClosed {
+		t.Errorf("expected closed; actual: %s", s)
+	}
+}
+
+func TestCircuitBreakerZeroValue(t *testing.T) {
+	var b CircuitBreaker
+
+	for i := 1; i < defaultBreakerThreshold; i++ {
+		b.Failure("backend:7")
+
+		if err := b.Allow("backend:7"); err != nil {
+			t.Fatalf("expected the circuit to stay closed after %d failures; actual: %v", i, err)
+		}
+
+		b.Cancel("backend:7")
+	}
+
+	b.Failure("backend:7")
+
+	if err := b.Allow("backend:7"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen after %d failures; actual: %v", defaultBreakerThreshold, err)
+	}
+
+	if s := b.State("backend:7"); s != BreakerOpen {
+		t.Errorf("expected open for the default cooldown; actual: %s", s)
+	}
+}
@@ -0,0 +1,280 @@
+package ch03
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+var ErrServerClosed = errors.New("server: closed")
+
+// Handler serves one connection. The server closes conn once ServeConn
+// returns. ctx is canceled when the server starts shutting down, which is the
+// handler's cue to finish what it's doing and return.
+type Handler interface {
+	ServeConn(ctx context.Context, conn net.Conn)
+}
+
+// HandlerFunc lets an ordinary function be a Handler.
+type HandlerFunc func(ctx context.Context, conn net.Conn)
+
+func (f HandlerFunc) ServeConn(ctx context.Context, conn net.Conn) {
+	f(ctx, conn)
+}
+
+// Server runs the accept loop every TCP server needs: each connection is
+// handed to Handler in its own goroutine and tracked until the handler
+// returns, so the server can be shut down cleanly. The zero value is ready to
+// use once Handler is set.
+type Server struct {
+	Handler Handler
+
+	// MaxConns caps the connections being served at once, across all
+	// listeners. Once it's reached, the server stops accepting until a
+	// connection finishes and the kernel's backlog holds the rest. Zero
+	// means no cap.
+	MaxConns int
+
+	once      sync.Once
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	handlers  sync.WaitGroup
+	slots     chan struct{}
+	done      chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closed    bool
+}
+
+func (s *Server) init() {
+	s.once.Do(func() {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[net.Conn]struct{})
+		s.done = make(chan struct{})
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+
+		if s.MaxConns > 0 {
+			s.slots = make(chan struct{}, s.MaxConns)
+		}
+	})
+}
+
+// Serve accepts connections on l until the server is shut down, then returns
+// ErrServerClosed. Accept errors that pass once resources are freed up, e.g.
+// running out of file descriptors, are retried with exponential backoff;
+// any other error closes l and is returned. Serve can be called for several
+// listeners at once.
+func (s *Server) Serve(l net.Listener) error {
+	s.init()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+
+		_ = l.Close()
+	}()
+
+	var delay time.Duration
+
+	for {
+		if s.slots != nil {
+			select {
+			case s.slots <- struct{}{}:
+			case <-s.done:
+				return ErrServerClosed
+			}
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			s.releaseSlot()
+
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+			}
+
+			if !temporaryAcceptError(err) {
+				return err
+			}
+
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+
+			if !s.sleep(delay) {
+				return ErrServerClosed
+			}
+
+			continue
+		}
+
+		delay = 0
+
+		if !s.track(conn) {
+			_ = conn.Close()
+			s.releaseSlot()
+
+			return ErrServerClosed
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+// ActiveConns returns the number of connections being served.
+func (s *Server) ActiveConns() int {
+	s.init()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns)
+}
+
+// Shutdown stops accepting connections and cancels the handlers' context,
+// then waits for every handler to return. If ctx is done first, the
+// remaining connections are closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+
+	drained := make(chan struct{})
+
+	go func() {
+		s.handlers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.closeConns()
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections and closes the ones being served without
+// waiting for their handlers.
+func (s *Server) Close() error {
+	s.stop()
+	s.closeConns()
+
+	return nil
+}
+
+// stop closes the listeners and tells the handlers to finish up.
+func (s *Server) stop() {
+	s.init()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+		s.cancel()
+	}
+
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+// track records conn, unless the server has been shut down in the meantime.
+// Adding to the WaitGroup under the lock, and only while open, keeps it from
+// racing with Shutdown's Wait.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	s.handlers.Add(1)
+
+	return true
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
+		s.releaseSlot()
+		s.handlers.Done()
+	}()
+
+	s.Handler.ServeConn(s.ctx, conn)
+}
+
+func (s *Server) releaseSlot() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// sleep waits for d, returning false if the server is shut down first.
+func (s *Server) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// temporaryAcceptError reports whether an Accept error is likely to pass on
+// its own: the process or system running short of file descriptors or
+// memory, or a connection that was aborted before it could be accepted.
+func temporaryAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,285 @@
+package ch03
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var echoHandler = HandlerFunc(func(_ context.Context, conn net.Conn) {
+	_, _ = io.Copy(conn, conn)
+})
+
+// startServer serves srv on a loopback listener, returning its address and
+// Serve's result.
+func startServer(t *testing.T, srv *Server) (string, <-chan error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(listener) }()
+
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return listener.Addr().String(), served
+}
+
+// echoes reports whether conn echoes msg back within timeout.
+func echoes(t *testing.T, conn net.Conn, msg string, timeout time.Duration) bool {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	buf := make([]byte, len(msg))
+	_, err := io.ReadFull(conn, buf)
+
+	return err == nil && string(buf) == msg
+}
+
+func TestServerServesAndTracks(t *testing.T) {
+	srv := &Server{Handler: echoHandler}
+	addr, served := startServer(t, srv)
+
+	conns := make([]net.Conn, 3)
+
+	for i := range conns {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if !echoes(t, conn, "ping", time.Second) {
+			t.Fatalf("expected conn %d to be echoed", i)
+		}
+
+		conns[i] = conn
+	}
+
+	if n := srv.ActiveConns(); n != 3 {
+		t.Errorf("expected 3 active connections; actual: %d", n)
+	}
+
+	_ = conns[0].Close()
+	time.Sleep(50 * time.Millisecond)
+
+	if n := srv.ActiveConns(); n != 2 {
+		t.Errorf("expected 2 active connections; actual: %d", n)
+	}
+
+	_ = srv.Close()
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed; actual: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.Serve(listener); err != ErrServerClosed {
+		t.Errorf("expected Serve on a closed server to fail; actual: %v", err)
+	}
+}
+
+func TestServerMaxConns(t *testing.T) {
+	srv := &Server{Handler: echoHandler, MaxConns: 1}
+	addr, _ := startServer(t, srv)
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	if !echoes(t, first, "first", time.Second) {
+		t.Fatal("expected the first connection to be echoed")
+	}
+
+	// The kernel completes the handshake, but the server won't take the
+	// connection on until the first one is done.
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	if echoes(t, second, "second", 100*time.Millisecond) {
+		t.Fatal("expected the second connection to wait")
+	}
+
+	_ = first.Close()
+
+	buf := make([]byte, len("second"))
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err := io.ReadFull(second, buf); err != nil || string(buf) != "second" {
+		t.Errorf("expected the second connection to be served; actual: %q, %v", buf, err)
+	}
+}
+
+// flakyListener fails Accept with errs before accepting for real.
+type flakyListener struct {
+	net.Listener
+	errs    []error
+	accepts int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if n := atomic.AddInt32(&l.accepts, 1); int(n) <= len(l.errs) {
+		return nil, l.errs[n-1]
+	}
+
+	return l.Listener.Accept()
+}
+
+func TestServerAcceptBackoff(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make([]error, 5)
+	for i := range errs {
+		errs[i] = &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+
+	srv := &Server{Handler: echoHandler}
+	defer srv.Close()
+
+	start := time.Now()
+	go func() { _ = srv.Serve(&flakyListener{Listener: listener, errs: errs}) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !echoes(t, conn, "ping", time.Second) {
+		t.Fatal("expected the server to recover from temporary errors")
+	}
+
+	// 5+10+20+40+80ms of backoff.
+	if elapsed := time.Since(start); elapsed < 155*time.Millisecond {
+		t.Errorf("expected Accept to back off; actual: %s", elapsed)
+	}
+
+	fatal := errors.New("fatal")
+
+	other := &Server{Handler: echoHandler}
+	if err := other.Serve(&flakyListener{Listener: listener, errs: []error{fatal}}); err != fatal {
+		t.Errorf("expected Serve to return the fatal error; actual: %v", err)
+	}
+}
+
+func TestServerShutdownDrains(t *testing.T) {
+	srv := &Server{Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) {
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond) // finishing up
+		_, _ = conn.Write([]byte("bye"))
+	})}
+	addr, served := startServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for srv.ActiveConns() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("expected Shutdown to drain; actual: %v", err)
+	}
+
+	if n := srv.ActiveConns(); n != 0 {
+		t.Errorf("expected no active connections; actual: %d", n)
+	}
+
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "bye" {
+		t.Errorf("expected the handler to finish; actual: %q, %v", b, err)
+	}
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed; actual: %v", err)
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("expected the listener to be closed")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	srv := &Server{Handler: echoHandler} // ignores ctx
+	addr, _ := startServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !echoes(t, conn, "ping", time.Second) {
+		t.Fatal("expected the connection to be echoed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected Shutdown to time out; actual: %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection to be closed; actual: %v", err)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	srv := &Server{Handler: echoHandler}
+	addr, served := startServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !echoes(t, conn, "ping", time.Second) {
+		t.Fatal("expected the connection to be echoed")
+	}
+
+	_ = srv.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection to be closed; actual: %v", err)
+	}
+
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed; actual: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package ch03
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// DialTrace has hooks that are called as a dial progresses, much like
+// httptrace.ClientTrace, so a slow connection can be pinned on DNS, the TCP
+// connect or the TLS handshake. Any of the hooks may be nil. Hooks can be
+// called from several goroutines at once when addresses are raced.
+type DialTrace struct {
+	DNSStart func(host string)
+	DNSDone  func(addrs []net.IPAddr, err error)
+
+	// ConnectStart and ConnectDone are called once for every address tried.
+	ConnectStart func(network, address string)
+	ConnectDone  func(network, address string, err error)
+
+	TLSHandshakeStart func()
+	TLSHandshakeDone  func(state tls.ConnectionState, err error)
+}
+
+type dialTraceKey struct{}
+
+// WithDialTrace returns a copy of ctx that carries trace. The dialers in
+// this package, tlsutil and the tools built on them call its hooks. A trace
+// already in ctx is replaced.
+func WithDialTrace(ctx context.Context, trace *DialTrace) context.Context {
+	return context.WithValue(ctx, dialTraceKey{}, trace)
+}
+
+// ContextDialTrace returns the trace carried by ctx, or nil.
+func ContextDialTrace(ctx context.Context) *DialTrace {
+	trace, _ := ctx.Value(dialTraceKey{}).(*DialTrace)
+	return trace
+}
+
+func (t *DialTrace) dnsStart(host string) {
+	if t != nil && t.DNSStart != nil {
+		t.DNSStart(host)
+	}
+}
+
+func (t *DialTrace) dnsDone(addrs []net.IPAddr, err error) {
+	if t != nil && t.DNSDone != nil {
+		t.DNSDone(addrs, err)
+	}
+}
+
+func (t *DialTrace) connectStart(network, address string) {
+	if t != nil && t.ConnectStart != nil {
+		t.ConnectStart(network, address)
+	}
+}
+
+func (t *DialTrace) connectDone(network, address string, err error) {
+	if t != nil && t.ConnectDone != nil {
+		t.ConnectDone(network, address, err)
+	}
+}
+
+// TLSHandshake runs conn's handshake, reporting it to the trace in ctx.
+func TLSHandshake(ctx context.Context, conn *tls.Conn) error {
+	trace := ContextDialTrace(ctx)
+
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+
+	err := conn.HandshakeContext(ctx)
+
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(conn.ConnectionState(), err)
+	}
+
+	return err
+}
+
+// errAttemptFailed is reported for an address net.Dialer gave up on, since it
+// doesn't say why.
+var errAttemptFailed = errors.New("dial: connection attempt failed")
+
+// DialContext dials address on the named network, reporting the DNS lookup
+// and each connect to the DialTrace in ctx, if any. TCP goes through an
+// EyeballsDialer, so a host's addresses are raced whether or not the dial is
+// traced. Anything else is dialed with net.Dialer, and the trace only sees
+// the addresses it connects to, not the lookup.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		conn, _, err := (&EyeballsDialer{}).DialContext(ctx, network, address)
+		return conn, err
+	}
+
+	trace := ContextDialTrace(ctx)
+	if trace == nil {
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+
+	var last string
+
+	d := net.Dialer{
+		// net.Dialer only moves on to the next address once the last one
+		// failed.
+		Control: func(_, addr string, _ syscall.RawConn) error {
+			if last != "" {
+				trace.connectDone(network, last, errAttemptFailed)
+			}
+
+			last = addr
+			trace.connectStart(network, addr)
+
+			return nil
+		},
+	}
+
+	conn, err := d.DialContext(ctx, network, address)
+
+	if last != "" {
+		trace.connectDone(network, last, err)
+	}
+
+	return conn, err
+}
+
+// matchesFamily reports whether ip can be used on network, e.g. only IPv4
+// addresses on tcp4.
+func matchesFamily(network string, ip net.IPAddr) bool {
+	isV4 := ip.IP.To4() != nil
+
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return isV4
+	case strings.HasSuffix(network, "6"):
+		return !isV4
+	default:
+		return true
+	}
+}
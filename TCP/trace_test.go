@@ -0,0 +1,144 @@
+package ch03
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// traceRecorder builds a DialTrace that logs the events it sees.
+type traceRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *traceRecorder) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, event)
+}
+
+func (r *traceRecorder) trace() *DialTrace {
+	return &DialTrace{
+		DNSStart: func(host string) { r.record("dns start " + host) },
+		DNSDone: func(addrs []net.IPAddr, err error) {
+			if err != nil {
+				r.record("dns failed")
+				return
+			}
+
+			r.record("dns done")
+		},
+		ConnectStart: func(network, address string) { r.record("connect start " + address) },
+		ConnectDone: func(network, address string, err error) {
+			if err != nil {
+				r.record("connect failed " + address)
+				return
+			}
+
+			r.record("connect done " + address)
+		},
+	}
+}
+
+func (r *traceRecorder) check(t *testing.T, expected ...string) {
+	t.Helper()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !reflect.DeepEqual(r.events, expected) {
+		t.Errorf("expected events %q; actual: %q", expected, r.events)
+	}
+}
+
+func TestDialContextTrace(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	var r traceRecorder
+	ctx := WithDialTrace(context.Background(), r.trace())
+
+	conn, err := DialContext(ctx, "tcp4", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	addr := listener.Addr().String()
+	r.check(t, "dns start localhost", "dns done", "connect start "+addr, "connect done "+addr)
+
+	if ContextDialTrace(context.Background()) != nil {
+		t.Error("expected no trace in a plain context")
+	}
+}
+
+func TestRetryDialerTrace(t *testing.T) {
+	addr := refusedAddress(t)
+
+	var r traceRecorder
+	ctx := WithDialTrace(context.Background(), r.trace())
+
+	d := NewRetryDialer()
+	d.MaxAttempts = 2
+	d.jitter = func(time.Duration) time.Duration { return 0 }
+
+	_, err := d.DialContext(ctx, "tcp", addr)
+	if err == nil {
+		t.Fatal("expected dial to fail")
+	}
+
+	// IP addresses need no lookup, and each attempt is traced.
+	r.check(t, "connect start "+addr, "connect failed "+addr, "connect start "+addr, "connect failed "+addr)
+}
+
+func TestEyeballsDialerTrace(t *testing.T) {
+	port := loopbackListeners(t, "127.0.0.1")
+	refused := net.JoinHostPort("127.0.0.4", port)
+	accepted := net.JoinHostPort("127.0.0.1", port)
+
+	var r traceRecorder
+	ctx := WithDialTrace(context.Background(), r.trace())
+
+	d := &EyeballsDialer{Resolver: staticResolver{"127.0.0.4", "127.0.0.1"}}
+
+	conn, _, err := d.DialContext(ctx, "tcp", net.JoinHostPort("example.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	r.check(t, "dns start example.test", "dns done",
+		"connect start "+refused, "connect failed "+refused,
+		"connect start "+accepted, "connect done "+accepted)
+}
+
+func TestDialContextTraceUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var r traceRecorder
+	ctx := WithDialTrace(context.Background(), r.trace())
+
+	addr := conn.LocalAddr().String()
+
+	client, err := DialContext(ctx, "udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	r.check(t, "connect start "+addr, "connect done "+addr)
+}
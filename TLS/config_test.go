@@ -0,0 +1,177 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+// handshake runs both ends of a TLS handshake over an in-memory pipe.
+func handshake(t *testing.T, server, client *tls.Config) (serverErr, clientErr error) {
+	t.Helper()
+
+	sPipe, cPipe := net.Pipe()
+	sConn, cConn := newAsyncConn(sPipe), newAsyncConn(cPipe)
+	defer sConn.Close()
+	defer cConn.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		s := tls.Server(sConn, server)
+		err := s.Handshake()
+		if err == nil {
+			_, err = s.Write([]byte{1})
+		}
+		errs <- err
+		_ = sConn.Close()
+	}()
+
+	// TLS 1.3 clients finish their handshake before the server has looked
+	// at the client certificate, so wait for a byte from the server to find
+	// out whether it accepted us.
+	c := tls.Client(cConn, client)
+	clientErr = c.Handshake()
+	if clientErr == nil {
+		_, clientErr = c.Read(make([]byte, 1))
+	}
+
+	_ = cConn.Close()
+
+	return <-errs, clientErr
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca, err := NewTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert, err := ca.Issue("localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCert, err := ca.Issue("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCfg := ServerConfig(serverCert, ca.Pool())
+
+	sErr, cErr := handshake(t, serverCfg, ClientConfig(ca.Pool(), "localhost", &clientCert))
+	if sErr != nil || cErr != nil {
+		t.Fatalf("expected handshake to succeed; server: %v, client: %v", sErr, cErr)
+	}
+
+	// no client certificate
+	sErr, _ = handshake(t, serverCfg, ClientConfig(ca.Pool(), "localhost", nil))
+	if sErr == nil {
+		t.Error("expected server to reject a client without a certificate")
+	}
+
+	// client certificate from a different CA
+	other, err := NewTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherCert, err := other.Issue("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sErr, _ = handshake(t, serverCfg, ClientConfig(ca.Pool(), "localhost", &otherCert))
+	if sErr == nil {
+		t.Error("expected server to reject a client certificate from another CA")
+	}
+
+	// wrong server name
+	_, cErr = handshake(t, serverCfg, ClientConfig(ca.Pool(), "example.com", &clientCert))
+	if cErr == nil {
+		t.Error("expected client to reject the server's certificate")
+	}
+}
+
+func TestPinSPKI(t *testing.T) {
+	ca, err := NewTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned, err := ca.Issue("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same CA, same name, different key
+	unpinned, err := ca.Issue("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := ClientConfig(ca.Pool(), "localhost", nil)
+	PinSPKI(client, SPKIHash(pinned.Leaf))
+
+	_, cErr := handshake(t, ServerConfig(pinned, nil), client)
+	if cErr != nil {
+		t.Fatalf("expected pinned server to be accepted: %v", cErr)
+	}
+
+	_, cErr = handshake(t, ServerConfig(unpinned, nil), client)
+	if !errors.Is(cErr, ErrPinMismatch) {
+		t.Fatalf("expected ErrPinMismatch; actual: %v", cErr)
+	}
+}
+
+// asyncConn queues writes so both ends of a net.Pipe can write at once, as
+// they may when one side aborts a handshake with an alert while the other
+// is still sending. A plain net.Pipe would deadlock.
+type asyncConn struct {
+	net.Conn
+	mu     sync.Mutex
+	closed bool
+	writes chan []byte
+}
+
+func newAsyncConn(c net.Conn) *asyncConn {
+	a := &asyncConn{Conn: c, writes: make(chan []byte, 64)}
+
+	go func() {
+		for b := range a.writes {
+			if _, err := a.Conn.Write(b); err != nil {
+				break
+			}
+		}
+
+		_ = a.Conn.Close()
+	}()
+
+	return a
+}
+
+func (a *asyncConn) Write(b []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return 0, net.ErrClosed
+	}
+
+	a.writes <- append([]byte(nil), b...)
+
+	return len(b), nil
+}
+
+func (a *asyncConn) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.closed {
+		a.closed = true
+		close(a.writes)
+	}
+
+	return nil
+}
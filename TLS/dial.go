@@ -0,0 +1,39 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	ch03 "practice/network_programming/TCP"
+)
+
+// DialContext connects to address and completes the TLS handshake before
+// returning, reporting each step to the ch03.DialTrace in ctx, if any. If
+// cfg has no ServerName, it's taken from address.
+func DialContext(ctx context.Context, network, address string, cfg *tls.Config) (*tls.Conn, error) {
+	raw, err := ch03.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	conn := tls.Client(raw, cfg)
+
+	err = ch03.TLSHandshake(ctx, conn)
+	if err != nil {
+		_ = raw.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,120 @@
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	ch03 "practice/network_programming/TCP"
+)
+
+func TestDialContextTrace(t *testing.T) {
+	ca, err := NewTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := ca.Issue("localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:", ServerConfig(cert, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_ = conn.(*tls.Conn).Handshake()
+		_, _ = conn.Write([]byte{1})
+	}()
+
+	var (
+		connected bool
+		started   bool
+		state     tls.ConnectionState
+		tlsErr    error
+	)
+
+	ctx := ch03.WithDialTrace(context.Background(), &ch03.DialTrace{
+		ConnectDone:       func(_, _ string, err error) { connected = err == nil },
+		TLSHandshakeStart: func() { started = true },
+		TLSHandshakeDone: func(s tls.ConnectionState, err error) {
+			state, tlsErr = s, err
+		},
+	})
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	conn, err := DialContext(ctx, "tcp", net.JoinHostPort("localhost", port), ClientConfig(ca.Pool(), "", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !connected || !started {
+		t.Errorf("expected connect and handshake start to be traced; connected: %t, started: %t", connected, started)
+	}
+
+	if tlsErr != nil || !state.HandshakeComplete {
+		t.Errorf("expected a completed handshake; actual: %v", tlsErr)
+	}
+
+	if state.ServerName != "localhost" {
+		t.Errorf("expected server name taken from the address; actual: %q", state.ServerName)
+	}
+
+	_, _ = conn.Read(make([]byte, 1))
+}
+
+func TestDialContextHandshakeFailure(t *testing.T) {
+	ca, err := NewTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := ca.Issue("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:", ServerConfig(cert, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_ = conn.(*tls.Conn).Handshake()
+	}()
+
+	var tlsErr error
+
+	ctx := ch03.WithDialTrace(context.Background(), &ch03.DialTrace{
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) { tlsErr = err },
+	})
+
+	// The system roots don't trust the test CA.
+	_, err = DialContext(ctx, "tcp", listener.Addr().String(), ClientConfig(nil, "localhost", nil))
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+
+	if tlsErr == nil {
+		t.Error("expected the failure to be traced")
+	}
+}
@@ -0,0 +1,108 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a certificate from a PEM certificate and key file pair
+// and reloads it whenever either file's modification time changes, so
+// renewed certificates are picked up without restarting. If a reload fails,
+// e.g. because only one of the two files has been replaced so far, the
+// previous certificate stays in use.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	// FS is where the files are read from. If nil, they're read from the
+	// operating system; tests can use an fstest.MapFS instead.
+	FS fs.FS
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// NewCertReloader loads the certificate up front so a bad file is caught
+// when the server starts rather than on the first handshake.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+
+	_, err := r.Certificate()
+
+	return r, err
+}
+
+// Certificate returns the current certificate, reloading it if needed.
+func (r *CertReloader) Certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certInfo, certErr := r.stat(r.CertFile)
+	keyInfo, keyErr := r.stat(r.KeyFile)
+
+	if certErr == nil && keyErr == nil && r.cert != nil &&
+		certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return r.cert, nil
+	}
+
+	cert, err := r.load()
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+
+		return nil, err
+	}
+
+	r.cert = &cert
+	if certErr == nil && keyErr == nil {
+		r.certMod, r.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	}
+
+	return r.cert, nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate()
+}
+
+// GetClientCertificate is meant for tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate()
+}
+
+func (r *CertReloader) load() (tls.Certificate, error) {
+	certPEM, err := r.readFile(r.CertFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyPEM, err := r.readFile(r.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func (r *CertReloader) stat(name string) (fs.FileInfo, error) {
+	if r.FS == nil {
+		return os.Stat(name)
+	}
+
+	return fs.Stat(r.FS, name)
+}
+
+func (r *CertReloader) readFile(name string) ([]byte, error) {
+	if r.FS == nil {
+		return os.ReadFile(name)
+	}
+
+	return fs.ReadFile(r.FS, name)
+}
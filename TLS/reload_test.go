@@ -0,0 +1,63 @@
+package tlsutil
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestCertReloader(t *testing.T) {
+	ca, err := NewTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM, keyPEM, err := ca.IssuePEM("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	fsys := fstest.MapFS{
+		"cert.pem": {Data: certPEM, ModTime: now},
+		"key.pem":  {Data: keyPEM, ModTime: now},
+	}
+
+	r := &CertReloader{CertFile: "cert.pem", KeyFile: "key.pem", FS: fsys}
+
+	first, err := r.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// renew the certificate, one file at a time
+	certPEM, keyPEM, err = ca.IssuePEM("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys["cert.pem"] = &fstest.MapFile{Data: certPEM, ModTime: now.Add(time.Second)}
+
+	// The new certificate doesn't match the old key yet, so the old pair
+	// keeps being served.
+	actual, err := r.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(first.Certificate[0], actual.Certificate[0]) {
+		t.Fatal("expected the old certificate while the key is out of date")
+	}
+
+	fsys["key.pem"] = &fstest.MapFile{Data: keyPEM, ModTime: now.Add(time.Second)}
+
+	actual, err = r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(first.Certificate[0], actual.Certificate[0]) {
+		t.Fatal("expected the renewed certificate")
+	}
+}
@@ -2,8 +2,12 @@ package echo
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"os"
+
+	sockopt "practice/network_programming/Socket-Options"
+	ch03 "practice/network_programming/TCP"
 )
 
 func steamingEchoServer(ctx context.Context, network, address string) (net.Addr, error) {
@@ -13,41 +17,66 @@ func steamingEchoServer(ctx context.Context, network, address string) (net.Addr,
 		return nil, err
 	}
 
+	return serveStreamingEcho(ctx, s), nil
+}
+
+// steamingEchoServerTLS is steamingEchoServer behind TLS. Setting ClientCAs
+// and ClientAuth on cfg turns on client certificate verification.
+func steamingEchoServerTLS(ctx context.Context, network, address string, cfg *tls.Config) (net.Addr, error) {
+	s, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return serveStreamingEcho(ctx, tls.NewListener(s, cfg)), nil
+}
+
+// shardedEchoServer is steamingEchoServer with n SO_REUSEPORT listeners on
+// the same address, each with its own accept loop, so short-lived
+// connections aren't all accepted by one goroutine.
+func shardedEchoServer(ctx context.Context, network, address string, n int) (net.Addr, error) {
+	var opts sockopt.Options
+
+	listeners, err := opts.ListenShards(ctx, network, address, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return serveStreamingEcho(ctx, listeners...), nil
+}
+
+// serveStreamingEcho serves all the listeners, which share an address. Once
+// ctx is done no new connections are accepted, but the ones already open are
+// echoed until their clients hang up.
+func serveStreamingEcho(ctx context.Context, listeners ...net.Listener) net.Addr {
+	srv := &ch03.Server{Handler: ch03.HandlerFunc(echoConn)}
+
 	go func() {
-		go func() {
-			<-ctx.Done()
-			_ = s.Close()
-		}()
-
-		// spinning up infinite loop for accepting connections
-		for {
-			conn, err := s.Accept()
-			if err != nil {
-				return
-			}
-
-			// a goroutine is spun up to handle each individual connection
-			go func() {
-				defer func() { _ = conn.Close() }()
-
-				for {
-					buf := make([]byte, 1024)
-					n, err := conn.Read(buf)
-					if err != nil {
-						return
-					}
-
-					_, err = conn.Write(buf[:n])
-					if err != nil {
-						return
-					}
-				}
-			}()
-		}
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
 	}()
 
-	// this returns immediately since the code preceeding it runs in a goroutine.
-	return s.Addr(), nil
+	for _, s := range listeners {
+		go func(s net.Listener) { _ = srv.Serve(s) }(s)
+	}
+
+	// this returns immediately since the server runs in goroutines.
+	return listeners[0].Addr()
+}
+
+func echoConn(_ context.Context, conn net.Conn) {
+	for {
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		_, err = conn.Write(buf[:n])
+		if err != nil {
+			return
+		}
+	}
 }
 
 func datagramEchoServer(ctx context.Context, network, address string) (net.Addr, error) {
@@ -57,28 +86,55 @@ func datagramEchoServer(ctx context.Context, network, address string) (net.Addr,
 	}
 
 	go func() {
-		go func() {
-			<-ctx.Done()
-			_ = s.Close()
-
-			if network == "unixgram" {
-				os.Remove(address)
-			}
-		}()
+		<-ctx.Done()
+		_ = s.Close()
 
-		buf := make([]byte, 1024)
-		for {
-			n, clientAddr, err := s.ReadFrom(buf)
-			if err != nil {
-				return
-			}
-
-			_, err = s.WriteTo(buf[:n], clientAddr)
-			if err != nil {
-				return
-			}
+		if network == "unixgram" {
+			os.Remove(address)
 		}
 	}()
 
+	go serveDatagramEcho(s)
+
 	return s.LocalAddr(), nil
 }
+
+// shardedDatagramEchoServer is datagramEchoServer with n SO_REUSEPORT
+// sockets on the same address, each with its own read loop.
+func shardedDatagramEchoServer(ctx context.Context, network, address string, n int) (net.Addr, error) {
+	var opts sockopt.Options
+
+	conns, err := opts.ListenPacketShards(ctx, network, address, n)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		for _, s := range conns {
+			_ = s.Close()
+		}
+	}()
+
+	for _, s := range conns {
+		go serveDatagramEcho(s)
+	}
+
+	return conns[0].LocalAddr(), nil
+}
+
+func serveDatagramEcho(s net.PacketConn) {
+	buf := make([]byte, 1024)
+	for {
+		n, clientAddr, err := s.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		_, err = s.WriteTo(buf[:n], clientAddr)
+		if err != nil {
+			return
+		}
+	}
+}
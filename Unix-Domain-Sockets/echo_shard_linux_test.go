@@ -0,0 +1,120 @@
+package echo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	sockopt "practice/network_programming/Socket-Options"
+)
+
+func TestShardedEchoServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tcpAddr, err := shardedEchoServer(ctx, "tcp", "127.0.0.1:", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udpAddr, err := shardedDatagramEchoServer(ctx, "udp", "127.0.0.1:", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("ping")
+
+	for _, addr := range []net.Addr{tcpAddr, udpAddr} {
+		// Enough connections that every shard should see some.
+		for i := 0; i < 16; i++ {
+			conn, err := net.Dial(addr.Network(), addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := conn.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatalf("%s: %v", addr.Network(), err)
+			}
+
+			if !bytes.Equal(msg, buf) {
+				t.Errorf("%s: expected reply %q; actual reply %q", addr.Network(), msg, buf)
+			}
+
+			_ = conn.Close()
+		}
+	}
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := net.Dial("tcp", tcpAddr.String()); err == nil {
+		t.Error("expected every shard to be closed")
+	}
+}
+
+// BenchmarkShardedEchoServer measures the rate of short-lived connections,
+// each echoing one message, with one listener and with one per CPU (at least
+// four, so there's something to compare on small machines).
+func BenchmarkShardedEchoServer(b *testing.B) {
+	// Resetting rather than closing keeps the client from piling up
+	// TIME_WAIT sockets and running out of ports.
+	client := sockopt.Options{ResetOnClose: true}
+	msg := []byte("ping")
+
+	shards := runtime.NumCPU()
+	if shards < 4 {
+		shards = 4
+	}
+
+	for _, n := range []int{1, shards} {
+		b.Run(fmt.Sprintf("listeners=%d", n), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			addr, err := shardedEchoServer(ctx, "tcp", "127.0.0.1:", n)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			start := time.Now()
+
+			b.RunParallel(func(pb *testing.PB) {
+				buf := make([]byte, len(msg))
+
+				for pb.Next() {
+					conn, err := client.DialContext(ctx, "tcp", addr.String())
+					if err != nil {
+						b.Error(err)
+						return
+					}
+
+					_, err = conn.Write(msg)
+					if err == nil {
+						_, err = io.ReadFull(conn, buf)
+					}
+
+					_ = conn.Close()
+
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "conns/s")
+		})
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestEchoServerUnix(t *testing.T) {
@@ -65,3 +67,55 @@ func TestEchoServerUnix(t *testing.T) {
 	}
 
 }
+
+func TestEchoServerDrainsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	rAddr, err := steamingEchoServer(ctx, "tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", rAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	echo := func(msg string) {
+		t.Helper()
+
+		_, err := conn.Write([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, len(msg))
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		_, err = io.ReadFull(conn, buf)
+		if err != nil || string(buf) != msg {
+			t.Fatalf("expected reply %q; actual reply %q, %v", msg, buf, err)
+		}
+	}
+
+	echo("before")
+	cancel()
+
+	// The listener closes, but the open connection is still served.
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		c, err := net.Dial("tcp", rAddr.String())
+		if err != nil {
+			break
+		}
+
+		_ = c.Close()
+
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("listener still accepting after cancel")
+		}
+	}
+
+	echo("after")
+}
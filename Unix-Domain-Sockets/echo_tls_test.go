@@ -0,0 +1,76 @@
+package echo
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"testing"
+
+	tlsutil "practice/network_programming/TLS"
+)
+
+func TestEchoServerTLS(t *testing.T) {
+	ca, err := tlsutil.NewTestCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCert, err := ca.Issue("localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCert, err := ca.Issue("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rAddr, err := steamingEchoServerTLS(ctx, "tcp", "127.0.0.1:", tlsutil.ServerConfig(serverCert, ca.Pool()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := tlsutil.ClientConfig(ca.Pool(), "127.0.0.1", &clientCert)
+	tlsutil.PinSPKI(cfg, tlsutil.SPKIHash(serverCert.Leaf))
+
+	conn, err := tls.Dial("tcp", rAddr.String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	msg := []byte("ping")
+	_, err = conn.Write(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(msg, buf[:n]) {
+		t.Fatalf("expected reply %q, actual reply %q", msg, buf[:n])
+	}
+
+	// without a client certificate the server hangs up on us
+	anon, err := tls.Dial("tcp", rAddr.String(), tlsutil.ClientConfig(ca.Pool(), "127.0.0.1", nil))
+	if err == nil {
+		defer func() { _ = anon.Close() }()
+
+		_, err = anon.Write(msg)
+		if err == nil {
+			_, err = anon.Read(buf)
+		}
+	}
+
+	if err == nil {
+		t.Fatal("expected server to reject a client without a certificate")
+	}
+}
@@ -1,3 +1,5 @@
 module practice/network_programming
 
 go 1.18
+
+require golang.org/x/sys v0.20.0